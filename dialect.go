@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect is the SQL flavour of the configured database driver.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite3"
+	Postgres Dialect = "postgres"
+)
+
+func dialectFor(driver string) (Dialect, error) {
+	switch Dialect(driver) {
+	case SQLite, Postgres:
+		return Dialect(driver), nil
+	}
+	return "", fmt.Errorf("unsupported database driver: %s", driver)
+}
+
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insert runs an INSERT into a table with an id primary key and returns the
+// new id. PostgreSQL has no LastInsertId, so it asks for the id back instead.
+func (d Dialect) insert(q queryer, statement string, args ...interface{}) (int, error) {
+	if d == Postgres {
+		var id int
+		err := q.QueryRow(statement+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := q.Exec(statement, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// isUniqueViolation reports whether err is a statement breaking a unique
+// constraint or index, whichever driver returned it.
+func isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique
+	case *pq.Error:
+		return e.Code == "23505"
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+)
+
+const problemContentType = "application/problem+json"
+
+// errorCode identifies a kind of failure. It is the last part of the problem
+// type URI, so clients can act on it rather than on the wording of details.
+type errorCode string
+
+const (
+	codeInvalidRequest       errorCode = "invalid-request"
+	codeValidation           errorCode = "validation-failed"
+	codeUnauthorized         errorCode = "unauthorized"
+	codeForbidden            errorCode = "forbidden"
+	codeNotFound             errorCode = "not-found"
+	codeConflict             errorCode = "conflict"
+	codeGone                 errorCode = "gone"
+	codePreconditionFailed   errorCode = "precondition-failed"
+	codeUnsupportedMediaType errorCode = "unsupported-media-type"
+	codeUnprocessable        errorCode = "unprocessable"
+	codePreconditionRequired errorCode = "precondition-required"
+	codeInternal             errorCode = "internal"
+
+	codeOrderNotFound     errorCode = "order-not-found"
+	codeOrderLocked       errorCode = "order-locked"
+	codeEmptyOrder        errorCode = "empty-order"
+	codeStaleOrder        errorCode = "stale-order"
+	codeRestoreExpired    errorCode = "restore-expired"
+	codeInvalidTransition errorCode = "invalid-transition"
+	codeInvalidItems      errorCode = "invalid-items"
+	codeInsufficientStock errorCode = "insufficient-stock"
+	codeStockReserved     errorCode = "stock-reserved"
+	codeDuplicateSKU      errorCode = "duplicate-sku"
+	codeInvalidPatch      errorCode = "invalid-patch"
+	codePatchTestFailed   errorCode = "patch-test-failed"
+
+	codeDuplicateEmail      errorCode = "duplicate-email"
+	codeEmailUnverified     errorCode = "email-unverified"
+	codeInvalidVerification errorCode = "invalid-verification"
+	codeVerificationExpired errorCode = "verification-expired"
+)
+
+// errorKinds gives the status and title every problem of a code is sent with.
+var errorKinds = map[errorCode]struct {
+	status int
+	title  string
+}{
+	codeInvalidRequest:       {http.StatusBadRequest, "Bad Request"},
+	codeValidation:           {http.StatusBadRequest, "Validation failed"},
+	codeUnauthorized:         {http.StatusUnauthorized, "Unauthorized"},
+	codeForbidden:            {http.StatusForbidden, "Forbidden"},
+	codeNotFound:             {http.StatusNotFound, "Not Found"},
+	codeConflict:             {http.StatusConflict, "Conflict"},
+	codeGone:                 {http.StatusGone, "Gone"},
+	codePreconditionFailed:   {http.StatusPreconditionFailed, "Precondition Failed"},
+	codeUnsupportedMediaType: {http.StatusUnsupportedMediaType, "Unsupported Media Type"},
+	codeUnprocessable:        {http.StatusUnprocessableEntity, "Unprocessable Entity"},
+	codePreconditionRequired: {http.StatusPreconditionRequired, "Precondition Required"},
+	codeInternal:             {http.StatusInternalServerError, "Internal Server Error"},
+
+	codeOrderNotFound:     {http.StatusNotFound, "Order not found"},
+	codeOrderLocked:       {http.StatusConflict, "Order is locked"},
+	codeEmptyOrder:        {http.StatusConflict, "Order is empty"},
+	codeStaleOrder:        {http.StatusPreconditionFailed, "Order is stale"},
+	codeRestoreExpired:    {http.StatusGone, "Restore window expired"},
+	codeInvalidTransition: {http.StatusConflict, "Invalid status transition"},
+	codeInvalidItems:      {http.StatusBadRequest, "Invalid items"},
+	codeInsufficientStock: {http.StatusConflict, "Insufficient stock"},
+	codeStockReserved:     {http.StatusConflict, "Stock is reserved"},
+	codeDuplicateSKU:      {http.StatusConflict, "Duplicate SKU"},
+	codeInvalidPatch:      {http.StatusUnprocessableEntity, "Invalid patch"},
+	codePatchTestFailed:   {http.StatusConflict, "Patch test failed"},
+
+	codeDuplicateEmail:      {http.StatusConflict, "Duplicate email"},
+	codeEmailUnverified:     {http.StatusForbidden, "Email not verified"},
+	codeInvalidVerification: {http.StatusBadRequest, "Invalid verification link"},
+	codeVerificationExpired: {http.StatusGone, "Verification link expired"},
+}
+
+// statusCodes picks the generic code for errors only known by their status.
+var statusCodes = map[int]errorCode{
+	http.StatusBadRequest:           codeInvalidRequest,
+	http.StatusUnauthorized:         codeUnauthorized,
+	http.StatusForbidden:            codeForbidden,
+	http.StatusNotFound:             codeNotFound,
+	http.StatusConflict:             codeConflict,
+	http.StatusGone:                 codeGone,
+	http.StatusPreconditionFailed:   codePreconditionFailed,
+	http.StatusUnsupportedMediaType: codeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:  codeUnprocessable,
+	http.StatusPreconditionRequired: codePreconditionRequired,
+	http.StatusInternalServerError:  codeInternal,
+}
+
+// fieldError is a violation of a single field of a request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// appError is a failure with a code. Detail is shown to clients and Fields
+// lists what was wrong with the request, if that is known.
+type appError struct {
+	Code   errorCode
+	Detail string
+	Fields []fieldError
+}
+
+func (e *appError) Error() string {
+	return e.Detail
+}
+
+// invalidField builds the error for a single field failing validation.
+func invalidField(field, message string) *appError {
+	return &appError{Code: codeValidation, Detail: message, Fields: []fieldError{{field, message}}}
+}
+
+// problem is an RFC 7807 problem details object. Items lists the shortages
+// of insufficient-stock problems.
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+	Items  []Shortage   `json:"items,omitempty"`
+}
+
+func newProblem(code errorCode, detail string) problem {
+	kind := errorKinds[code]
+	return problem{Type: "/problems/" + string(code), Title: kind.title, Status: kind.status, Detail: detail}
+}
+
+// problemFor maps the errors of the repositories and request parsing to
+// problems. Anything it does not know is an internal error, described by
+// fallback so its cause is not leaked to clients.
+func problemFor(err error, fallback string) problem {
+	switch err {
+	case errOrderNotFound:
+		return newProblem(codeOrderNotFound, err.Error())
+	case errOrderLocked:
+		return newProblem(codeOrderLocked, err.Error())
+	case errEmptyOrder:
+		return newProblem(codeEmptyOrder, err.Error())
+	case errStaleOrder:
+		return newProblem(codeStaleOrder, err.Error())
+	case errRestoreExpired:
+		return newProblem(codeRestoreExpired, err.Error())
+	case errStockReserved:
+		return newProblem(codeStockReserved, err.Error())
+	case errDuplicateSKU:
+		return newProblem(codeDuplicateSKU, err.Error())
+	case errPatchTestFailed:
+		return newProblem(codePatchTestFailed, err.Error())
+	case errDuplicateEmail:
+		return newProblem(codeDuplicateEmail, err.Error())
+	}
+
+	switch e := err.(type) {
+	case *appError:
+		p := newProblem(e.Code, e.Detail)
+		p.Errors = e.Fields
+		return p
+	case *invalidTransitionError:
+		return newProblem(codeInvalidTransition, e.Error()+".")
+	case *invalidPatchError:
+		return newProblem(codeInvalidPatch, e.Error()+".")
+	case *invalidItemsError:
+		p := newProblem(codeInvalidItems, e.Error()+".")
+		for _, id := range e.IDs {
+			p.Errors = append(p.Errors, fieldError{"items", fmt.Sprintf("item %d is unknown or archived", id)})
+		}
+		return p
+	case *insufficientStockError:
+		p := newProblem(codeInsufficientStock, "Insufficient stock.")
+		p.Items = e.Items
+		return p
+	}
+
+	return newProblem(codeInternal, fallback)
+}
+
+// respondWithProblem sends the problem an error maps to; fallback is the
+// detail of internal errors.
+func respondWithProblem(w http.ResponseWriter, err error, fallback string) {
+	writeProblem(w, problemFor(err, fallback))
+}
+
+// respondWithError sends a problem of the generic type for the status.
+func respondWithError(w http.ResponseWriter, code int, message string) {
+	writeProblem(w, newProblem(statusCodes[code], message))
+}
+
+func writeProblem(w http.ResponseWriter, p problem) {
+	if p.Status == 0 {
+		log.Error("problem without a status: ", p.Type)
+		p.Status = http.StatusInternalServerError
+	}
+
+	response, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	w.Write(response)
+}
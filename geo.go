@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusMiles = 3958.8
+
+// Centroid is the latitude/longitude at the center of a zipcode.
+type Centroid struct {
+	Lat float64
+	Lon float64
+}
+
+// Zipcodes resolves zipcodes to their centroids.
+type Zipcodes map[int]Centroid
+
+// LoadZipcodes reads a CSV of zip,latitude,longitude rows with a header, or
+// the tab separated Census ZCTA gazetteer file as it is published.
+func LoadZipcodes(path string) (Zipcodes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readZipcodes(f)
+}
+
+// zipcodeColumns are the header names of the zip, latitude and longitude
+// columns, first in our CSV and then in the gazetteer.
+var zipcodeColumns = [3][]string{
+	{"zip", "GEOID"},
+	{"latitude", "INTPTLAT"},
+	{"longitude", "INTPTLONG"},
+}
+
+func readZipcodes(r io.Reader) (Zipcodes, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	reader := csv.NewReader(io.MultiReader(strings.NewReader(header), br))
+	if strings.Contains(header, "\t") {
+		reader.Comma = '\t'
+	}
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) < 2 {
+		return nil, errors.New("Zipcode dataset is empty.")
+	}
+
+	var columns [3]int
+	for i, names := range zipcodeColumns {
+		columns[i] = -1
+		for j, name := range records[0] {
+			for _, n := range names {
+				if strings.TrimSpace(name) == n {
+					columns[i] = j
+				}
+			}
+		}
+		if columns[i] < 0 {
+			return nil, fmt.Errorf("zipcode dataset has no %s column", names[0])
+		}
+	}
+
+	z := Zipcodes{}
+	for line, record := range records[1:] {
+		zip, err := strconv.Atoi(strings.TrimSpace(record[columns[0]]))
+		if err != nil {
+			return nil, fmt.Errorf("zipcode dataset line %d: %v", line+2, err)
+		}
+
+		lat, err := strconv.ParseFloat(strings.TrimSpace(record[columns[1]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("zipcode dataset line %d: %v", line+2, err)
+		}
+
+		lon, err := strconv.ParseFloat(strings.TrimSpace(record[columns[2]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("zipcode dataset line %d: %v", line+2, err)
+		}
+
+		z[zip] = Centroid{Lat: lat, Lon: lon}
+	}
+
+	return z, nil
+}
+
+// nearestStore ranks the stores by great circle distance from the centroid.
+// Store coordinates follow the Walmart API order of [longitude, latitude];
+// stores without coordinates are never picked.
+func nearestStore(from Centroid, stores []Store) (Store, bool) {
+	var nearest Store
+	found := false
+
+	for _, s := range stores {
+		if len(s.Coordinates) != 2 {
+			continue
+		}
+
+		d := haversine(from, Centroid{Lat: s.Coordinates[1], Lon: s.Coordinates[0]})
+		if !found || d < nearest.Distance {
+			nearest = s
+			nearest.Distance = d
+			found = true
+		}
+	}
+
+	if found {
+		nearest.Distance = math.Floor(nearest.Distance*100+0.5) / 100
+	}
+
+	return nearest, found
+}
+
+// haversine returns the great circle distance between two points in miles.
+func haversine(a, b Centroid) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(h))
+}
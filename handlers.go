@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/common/log"
@@ -14,15 +19,65 @@ import (
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router       *mux.Router
+	DB           *sql.DB
+	Dialect      Dialect
+	Users        UserRepository
+	Orders       OrderRepository
+	Items        ItemRepository
+	Inventory    InventoryRepository
+	Idempotency  IdempotencyRepository
+	Sessions     SessionRepository
+	TokenSecret  []byte
+	StoreLocator StoreLocator
+	Zipcodes     Zipcodes
+	// TaxRate in basis points is applied to new orders.
+	TaxRate int
+	// Deleted orders can be restored for RestoreWindow and are purged after
+	// OrderRetention.
+	RestoreWindow  time.Duration
+	OrderRetention time.Duration
+	// Mailer sends the verification links, which point at BaseURL. Verified
+	// users are redirected to VerifiedRedirect if it is set.
+	Mailer           Mailer
+	BaseURL          string
+	VerifiedRedirect string
 }
 
-func (a *App) InitDB(dbName string) error {
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	sessionKey
+)
+
+// InitDB opens the database and applies pending migrations.
+func (a *App) InitDB(driver, dbName string) error {
+	if err := a.OpenDB(driver, dbName); err != nil {
+		return err
+	}
+
+	if err := migrateUp(a.DB, a.Dialect); err != nil {
+		log.Error("migrating ", dbName, " failed: ", err)
+		return err
+	}
+
+	log.Info("running on port :8080")
+	return nil
+}
+
+// OpenDB connects to the database as it is, without migrating it.
+func (a *App) OpenDB(driver, dbName string) error {
 	var err error
-	a.DB, err = sql.Open("sqlite3", dbName)
+	a.Dialect, err = dialectFor(driver)
 	if err != nil {
-		log.Error("can not open connection to sqlite3 db: ", dbName)
+		log.Error(err)
+		return err
+	}
+
+	a.DB, err = sql.Open(driver, dbName)
+	if err != nil {
+		log.Error("can not open connection to ", driver, " db: ", dbName)
 		return err
 	}
 
@@ -32,44 +87,139 @@ func (a *App) InitDB(dbName string) error {
 		return err
 	}
 
+	repository := NewSQLRepository(a.DB, a.Dialect)
+	a.Users = repository
+	a.Orders = repository
+	a.Items = repository
+	a.Inventory = repository
+	a.Idempotency = repository
+	a.Sessions = repository
+
 	log.Info("successful connection to DB: ", dbName)
-	log.Info("running on port :8080")
 	return nil
 }
 
 func (a *App) InitRouter() {
 	a.Router = mux.NewRouter()
+	a.Router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError(w, http.StatusNotFound, "Not found.")
+	})
+
+	generatedSecret := false
+	if a.TokenSecret == nil {
+		secret := os.Getenv("FRANKLIN_TOKEN_SECRET")
+		if secret == "" {
+			log.Error("FRANKLIN_TOKEN_SECRET is not set, tokens will not survive a restart.")
+			a.TokenSecret = newTokenSecret()
+			generatedSecret = true
+		} else {
+			a.TokenSecret = []byte(secret)
+		}
+	}
 
-	a.Router.HandleFunc("/users/{id:[0-9]+}", a.basicAuth(a.getUser)).Methods("GET")
-	a.Router.HandleFunc("/users", a.createUser).Methods("POST")
+	if a.StoreLocator == nil {
+		a.StoreLocator = newStoreLocator()
+	}
 
-	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.basicAuth(a.getOrder)).Queries("user_id", "{user_id}").Methods("GET")
-	a.Router.HandleFunc("/orders", a.basicAuth(a.getOrders)).Queries("user_id", "{user_id}").Methods("GET")
-	a.Router.HandleFunc("/orders", a.basicAuth(a.createOrder)).Methods("POST")
-	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.basicAuth(a.updateOrder)).Methods("PUT")
-	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.basicAuth(a.deleteOrder)).Methods("DELETE")
+	if a.Zipcodes == nil {
+		path := os.Getenv("FRANKLIN_ZIPCODES")
+		if path == "" {
+			path = "data/zipcodes.csv"
+		}
+
+		// Signups need a centroid to find the closest store from.
+		zipcodes, err := LoadZipcodes(path)
+		if err != nil {
+			log.Fatal("zipcode centroids could not be loaded from ", path, ": ", err)
+		}
+		a.Zipcodes = zipcodes
+	}
+
+	if a.TaxRate == 0 {
+		if rate := os.Getenv("FRANKLIN_TAX_RATE"); rate != "" {
+			bps, err := strconv.Atoi(rate)
+			if err != nil || bps < 0 {
+				log.Fatal("FRANKLIN_TAX_RATE must be a non-negative number of basis points: ", rate)
+			}
+			a.TaxRate = bps
+		}
+	}
+
+	if a.RestoreWindow == 0 {
+		a.RestoreWindow = durationEnv("FRANKLIN_RESTORE_WINDOW", defaultRestoreWindow)
+	}
+
+	if a.OrderRetention == 0 {
+		a.OrderRetention = durationEnv("FRANKLIN_ORDER_RETENTION", defaultOrderRetention)
+	}
+
+	if a.OrderRetention < a.RestoreWindow {
+		log.Fatal("FRANKLIN_ORDER_RETENTION can not be shorter than FRANKLIN_RESTORE_WINDOW.")
+	}
+
+	if a.Mailer == nil {
+		a.Mailer = newMailer()
+
+		// Verification links are signed with the secret, so mailed ones
+		// would stop working on the next restart.
+		if _, logged := a.Mailer.(logMailer); !logged && generatedSecret {
+			log.Fatal("FRANKLIN_TOKEN_SECRET must be set when verification links are mailed.")
+		}
+	}
+
+	if a.BaseURL == "" {
+		a.BaseURL = os.Getenv("FRANKLIN_BASE_URL")
+		if a.BaseURL == "" {
+			a.BaseURL = defaultBaseURL
+		}
+	}
+
+	if a.VerifiedRedirect == "" {
+		a.VerifiedRedirect = os.Getenv("FRANKLIN_VERIFIED_REDIRECT")
+	}
+
+	a.Router.HandleFunc("/users/{id:[0-9]+}", a.authenticate(a.authorize(a.getUser, roleUser, roleAdmin))).Methods("GET")
+	a.Router.HandleFunc("/users", a.authenticate(a.authorize(a.getUsers, roleAdmin))).Methods("GET")
+	a.Router.HandleFunc("/users", a.createUser).Methods("POST")
+	a.Router.HandleFunc("/users/verify", a.verifyEmail).Methods("GET")
+	a.Router.HandleFunc("/users/verify", a.resendVerification).Methods("POST")
+
+	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.authenticate(a.getOrder)).Methods("GET")
+	a.Router.HandleFunc("/orders", a.authenticate(a.getOrders)).Methods("GET")
+	a.Router.HandleFunc("/orders", a.authenticate(a.idempotent(a.createOrder))).Methods("POST")
+	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.authenticate(a.updateOrder)).Methods("PUT")
+	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.authenticate(a.patchOrder)).Methods("PATCH")
+	a.Router.HandleFunc("/orders/{id:[0-9]+}", a.authenticate(a.deleteOrder)).Methods("DELETE")
+	a.Router.HandleFunc("/orders/{id:[0-9]+}/transitions", a.authenticate(a.transitionOrder)).Methods("POST")
+	a.Router.HandleFunc("/orders/{id:[0-9]+}/history", a.authenticate(a.getOrderHistory)).Methods("GET")
+	a.Router.HandleFunc("/orders/{id:[0-9]+}/restore", a.authenticate(a.restoreOrder)).Methods("POST")
+
+	a.Router.HandleFunc("/items", a.authenticate(a.authorize(a.getItems, roleAdmin))).Methods("GET")
+	a.Router.HandleFunc("/items/{id:[0-9]+}", a.authenticate(a.authorize(a.getItem, roleAdmin))).Methods("GET")
+	a.Router.HandleFunc("/items", a.authenticate(a.authorize(a.createItem, roleAdmin))).Methods("POST")
+	a.Router.HandleFunc("/items/{id:[0-9]+}", a.authenticate(a.authorize(a.updateItem, roleAdmin))).Methods("PUT")
+	a.Router.HandleFunc("/items/{id:[0-9]+}/archive", a.authenticate(a.authorize(a.archiveItem, roleAdmin))).Methods("POST")
+
+	a.Router.HandleFunc("/stores/{no:[0-9]+}/inventory", a.authenticate(a.authorize(a.getInventory, roleAdmin))).Methods("GET")
+	a.Router.HandleFunc("/stores/{no:[0-9]+}/inventory/{item:[0-9]+}", a.authenticate(a.authorize(a.setStock, roleAdmin))).Methods("PUT")
 
 	a.Router.HandleFunc("/signin", a.basicAuth(a.signin)).Methods("POST")
+	a.Router.HandleFunc("/signout", a.authenticate(a.signout)).Methods("POST")
+	a.Router.HandleFunc("/token/refresh", a.refreshToken).Methods("POST")
 }
 
 // User handlers
 //
 //
 
-// TODO: need to add email verification with redirct to secure this
+// createUser signs up a user pending verification of their email address.
+// They can not sign in until they followed the link mailed to them.
 func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	u := User{}
 
-	err := json.NewDecoder(r.Body).Decode(&u)
-	if err != nil {
-		log.Error(err)
-		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
-		return
-	}
-
-	if !userValidations(u.Name, u.Password) {
-		log.Error("User name validation failed.")
-		respondWithError(w, http.StatusBadRequest, "username/password is invalid.")
+	if err := decodePayload(r.Body, &u, "User is invalid."); err != nil {
+		log.Error("User validation failed: ", err)
+		respondWithProblem(w, err, "User could not be created.")
 		return
 	}
 
@@ -77,55 +227,60 @@ func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Error(err)
 		respondWithError(w, http.StatusInternalServerError, "User could not be created.")
+		return
 	}
 
 	u.Password = string(hashedPassword)
 
-	u.ClosestStore, err = a.storeLocator(u.Zipcode)
+	// Admins are promoted out of band, never through signup.
+	u.Role = roleUser
+
+	u.ClosestStore, err = a.closestStore(u.Zipcode)
 	if err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusInternalServerError, "User could not be created.")
+		respondWithProblem(w, err, "User could not be created.")
 		return
 	}
 
-	if err := u.createUser(a.DB); err != nil {
+	if err := a.Users.CreateUser(&u); err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusInternalServerError, "User could not be created.")
+		respondWithProblem(w, err, "User could not be created.")
 		return
 	}
 
+	// The account exists either way, a new link can be requested.
+	if err := a.sendVerification(u); err != nil {
+		log.Error("sending verification to user ", u.ID, " failed: ", err)
+	}
+
 	respondWithJSON(w, http.StatusOK, u)
 }
 
-func (a *App) storeLocator(zipcode int) (Store, error) {
-
-	apiKey := os.Getenv("WALMART_OPEN_API_KEY")
-	if apiKey == "" {
-		log.Error("WALMART_OPEN_API_KEY is not set.")
+// closestStore is the store nearest to the zipcode's centroid. A zipcode
+// without a centroid is invalid, as there is nothing to measure from.
+func (a *App) closestStore(zipcode int) (Store, error) {
+	centroid, ok := a.Zipcodes[zipcode]
+	if !ok {
+		return Store{}, validationError("User is invalid.", []fieldError{{"zipcode", "is not a known ZIP code"}})
 	}
 
-	url := fmt.Sprintf("http://api.walmartlabs.com/v1/stores?apiKey=%s&zip=%s&format=json", apiKey, strconv.Itoa(zipcode))
-
-	resp, err := http.Get(url)
+	stores, err := a.StoreLocator.Locate(zipcode)
 	if err != nil {
-		log.Error(err)
 		return Store{}, err
 	}
-	defer resp.Body.Close()
 
-	var stores []Store
-	err = json.NewDecoder(resp.Body).Decode(&stores)
-	if err != nil {
-		log.Error(err)
-		return Store{}, err
+	if len(stores) == 0 {
+		return Store{}, fmt.Errorf("no stores found for zipcode %d", zipcode)
 	}
 
-	// TODO: Make this more intelligent (geo-location/order inventory based)
-	return stores[0], nil
+	store, ok := nearestStore(centroid, stores)
+	if !ok {
+		return Store{}, fmt.Errorf("none of the stores found for zipcode %d has coordinates", zipcode)
+	}
 
+	return store, nil
 }
 
-// FIXME: securing this based on username
 func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
@@ -135,8 +290,15 @@ func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	current := currentUser(r)
+	if !current.isAdmin() && current.ID != id {
+		log.Error("Unathorized attempt to read user ", id, " by user: ", current.Name)
+		respondWithError(w, http.StatusForbidden, "Forbidden.")
+		return
+	}
+
 	u := User{ID: id}
-	if err := u.getUser(a.DB); err != nil {
+	if err := a.Users.GetUser(&u); err != nil {
 		log.Error(err)
 		respondWithError(w, http.StatusNotFound, "User not found.")
 		return
@@ -144,6 +306,28 @@ func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, u)
 }
 
+func (a *App) getUsers(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	count, _ := strconv.Atoi(v.Get("count"))
+	start, _ := strconv.Atoi(v.Get("start"))
+
+	if count > 100 || count < 1 {
+		count = 100
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	users, err := a.Users.GetUsers(count, start)
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Users could not be listed.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, users)
+}
+
 // Order handlers
 //
 //
@@ -151,8 +335,6 @@ func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
 func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	userID := r.FormValue("user_id")
-
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
 		log.Error(err)
@@ -161,53 +343,59 @@ func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	o := Order{ID: id}
-	if err := o.getOrder(a.DB, userID); err != nil {
+	if err := a.Orders.GetOrder(&o, currentUser(r).ID); err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusNotFound, "Order not found.")
+		respondWithProblem(w, err, "Order could not be loaded.")
 		return
 	}
+	w.Header().Set("ETag", orderETag(o))
 	respondWithJSON(w, http.StatusOK, o)
 }
 
 func (a *App) createOrder(w http.ResponseWriter, r *http.Request) {
 	o := Order{}
-	err := json.NewDecoder(r.Body).Decode(&o)
-	if err != nil {
-		log.Error(err)
-		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
+	if err := decodePayload(r.Body, &o, "Order is invalid."); err != nil {
+		log.Error("Order validation failed: ", err)
+		respondWithProblem(w, err, "Order could not be created.")
 		return
 	}
 
-	if err := o.createOrder(a.DB); err != nil {
+	// Orders always belong to the authenticated user, whatever the body says.
+	user := currentUser(r)
+	o.UserID = user.ID
+	o.User = user.Name
+	o.TaxRate = a.TaxRate
+
+	if err := a.Orders.CreateOrder(&o); err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusInternalServerError, "order could not be created.")
+		respondWithProblem(w, err, "Order could not be created.")
 		return
 	}
 	respondWithJSON(w, http.StatusOK, o)
 }
 
 func (a *App) getOrders(w http.ResponseWriter, r *http.Request) {
-	userID := r.FormValue("user_id")
-	v := r.URL.Query()
-	count, _ := strconv.Atoi(v.Get("count"))
-	start, _ := strconv.Atoi(v.Get("start"))
-
-	// TODO: add proper valiations
-	if count > 10 || count < 1 {
-		count = 10
-	}
-	if start < 0 {
-		start = 0
+	q, err := parseOrderQuery(r.URL.Query())
+	if err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Orders could not be loaded.")
+		return
 	}
 
-	orders, err := getOrders(a.DB, userID, count, start)
+	orders, next, err := a.Orders.GetOrders(currentUser(r).ID, q)
 	if err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusNotFound, "No orders found.")
+		respondWithError(w, http.StatusInternalServerError, "Orders could not be loaded.")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, orders)
+	page := OrderPage{Orders: orders}
+	if next != nil {
+		page.NextCursor = encodeCursor(q.Sort, next)
+		w.Header().Set("Link", "<"+nextPageURL(r.URL, page.NextCursor)+">; rel=\"next\"")
+	}
+
+	respondWithJSON(w, http.StatusOK, page)
 }
 
 func (a *App) updateOrder(w http.ResponseWriter, r *http.Request) {
@@ -215,39 +403,125 @@ func (a *App) updateOrder(w http.ResponseWriter, r *http.Request) {
 	o := Order{}
 
 	vars := mux.Vars(r)
-	user, _, _ := r.BasicAuth()
 
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusBadRequest, "User ID is invalid.")
+		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
+		return
+	}
+
+	version, ok := ifMatch(r)
+	if !ok {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match header is required.")
+		return
+	}
+
+	if err := decodePayload(r.Body, &o, "Order is invalid."); err != nil {
+		log.Error("Order validation failed: ", err)
+		respondWithProblem(w, err, "Order could not be updated.")
 		return
 	}
 
+	user := currentUser(r)
 	o.ID = id
+	o.UserID = user.ID
+	o.User = user.Name
+	o.Version = version
 
-	err = json.NewDecoder(r.Body).Decode(&o)
+	if err := a.Orders.UpdateOrder(&o); err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Order could not be updated.")
+		return
+	}
+	w.Header().Set("ETag", orderETag(o))
+	respondWithJSON(w, http.StatusOK, o)
+}
+
+// patchOrder changes single lines of an order with a JSON Patch or a JSON
+// merge patch, instead of sending all of them like updateOrder.
+func (a *App) patchOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
 		log.Error(err)
 		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
 		return
 	}
 
-	if user != o.User {
-		log.Error("Unathorized attempt to update order by user: ", user)
-		respondWithError(w, http.StatusForbidden, "Forbidden.")
+	version, ok := ifMatch(r)
+	if !ok {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match header is required.")
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != jsonPatchType && contentType != mergePatchType {
+		w.Header().Set("Accept-Patch", jsonPatchType+", "+mergePatchType)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+jsonPatchType+" or "+mergePatchType+".")
+		return
+	}
+
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Patch is invalid.")
 		return
 	}
 
-	if err := o.updateOrder(a.DB); err != nil {
+	user := currentUser(r)
+	current := Order{ID: id}
+	if err := a.Orders.GetOrder(&current, user.ID); err != nil {
 		log.Error(err)
-		if err.Error() == "Order not found." {
-			respondWithError(w, http.StatusNotFound, "Order could not be found.")
+		respondWithProblem(w, err, "Order could not be updated.")
+		return
+	}
+
+	var lines Items
+	if contentType == jsonPatchType {
+		lines, err = applyJSONPatch(current.Items, patch)
+	} else {
+		lines, err = applyMergePatch(current.Items, patch)
+	}
+	if err != nil {
+		log.Error(err)
+		_, invalidPatch := err.(*invalidPatchError)
+		_, invalidLine := err.(*appError)
+		if invalidPatch || invalidLine || err == errPatchTestFailed {
+			respondWithProblem(w, err, "Order could not be updated.")
 		} else {
-			respondWithError(w, http.StatusInternalServerError, "Order could not be updated.")
+			respondWithError(w, http.StatusBadRequest, "Patch is invalid.")
 		}
 		return
 	}
+
+	o := Order{ID: id, UserID: user.ID, User: user.Name, Items: lines, Version: version}
+	if err := validationError("Order is invalid.", o.violations()); err != nil {
+		log.Error("Order validation failed: ", err)
+		respondWithProblem(w, err, "Order could not be updated.")
+		return
+	}
+
+	// The patch was applied to the version just read, so "*" can not let a
+	// concurrent change through either.
+	if o.Version == 0 {
+		o.Version = current.Version
+	}
+
+	if err := a.Orders.UpdateOrder(&o); err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Order could not be updated.")
+		return
+	}
+
+	o = Order{ID: id}
+	if err := a.Orders.GetOrder(&o, user.ID); err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Order could not be updated.")
+		return
+	}
+	w.Header().Set("ETag", orderETag(o))
 	respondWithJSON(w, http.StatusOK, o)
 }
 
@@ -255,42 +529,332 @@ func (a *App) deleteOrder(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 
-	user, _, _ := r.BasicAuth()
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
+		return
+	}
+
+	version, ok := ifMatch(r)
+	if !ok {
+		respondWithError(w, http.StatusPreconditionRequired, "If-Match header is required.")
+		return
+	}
+
+	user := currentUser(r)
+	o := Order{ID: id, UserID: user.ID, User: user.Name, Version: version}
+
+	if err := a.Orders.DeleteOrder(&o); err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Order could not be deleted.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, o)
+}
+
+// restoreOrder undoes the deletion of an order within the restore window.
+func (a *App) restoreOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
 
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
 		log.Error(err)
-		respondWithError(w, http.StatusBadRequest, "User ID is invalid.")
+		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
 		return
 	}
 
-	o := Order{}
-	o.ID = id
+	user := currentUser(r)
+	o := Order{ID: id, UserID: user.ID}
+
+	if err := a.Orders.RestoreOrder(&o, time.Now().Add(-a.RestoreWindow)); err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Order could not be restored.")
+		return
+	}
+
+	o = Order{ID: id}
+	if err := a.Orders.GetOrder(&o, user.ID); err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Order could not be restored.")
+		return
+	}
+	w.Header().Set("ETag", orderETag(o))
+	respondWithJSON(w, http.StatusOK, o)
+}
+
+// transitionOrder moves an order through its lifecycle. Customers can place
+// and cancel their own orders, admins can move any order along.
+func (a *App) transitionOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
 
-	err = json.NewDecoder(r.Body).Decode(&o)
+	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
 		log.Error(err)
 		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
 		return
 	}
 
-	if user != o.User {
-		log.Error("Unathorized attempt to delete order by user: ", user)
-		respondWithError(w, http.StatusForbidden, "Forbidden.")
+	var body struct {
+		Status string `json:"status"`
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || !validStatus(body.Status) {
+		log.Error("Order status validation failed: ", err)
+		respondWithError(w, http.StatusBadRequest, "Order status is invalid.")
+		return
+	}
+
+	user := currentUser(r)
+	o := Order{ID: id, UserID: user.ID}
+	if user.isAdmin() {
+		o.UserID = 0
+	}
+
+	if err := a.Orders.TransitionOrder(&o, body.Status); err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Order could not be transitioned.")
+		return
+	}
+
+	if err := a.Orders.GetOrder(&o, o.UserID); err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Order could not be transitioned.")
+		return
+	}
+	w.Header().Set("ETag", orderETag(o))
+	respondWithJSON(w, http.StatusOK, o)
+}
+
+// getOrderHistory lists every revision of an order's lines, deleted orders
+// included. Customers see their own orders, admins any order.
+func (a *App) getOrderHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Order ID is invalid.")
 		return
 	}
 
-	if err := o.deleteOrder(a.DB); err != nil {
+	user := currentUser(r)
+	userID := user.ID
+	if user.isAdmin() {
+		userID = 0
+	}
+
+	history, err := a.Orders.OrderHistory(id, userID)
+	if err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Order history could not be loaded.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// Item handlers
+//
+//
+
+func (a *App) getItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Item ID is invalid.")
+		return
+	}
+
+	i := Item{ID: id}
+	if err := a.Items.GetItem(&i); err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusNotFound, "Item not found.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, i)
+}
+
+func (a *App) getItems(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	count, _ := strconv.Atoi(v.Get("count"))
+	start, _ := strconv.Atoi(v.Get("start"))
+	archived, _ := strconv.ParseBool(v.Get("archived"))
+
+	if count > 100 || count < 1 {
+		count = 100
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	items, err := a.Items.GetItems(count, start, archived)
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Items could not be listed.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, items)
+}
+
+func (a *App) createItem(w http.ResponseWriter, r *http.Request) {
+	i := Item{}
+	if err := decodePayload(r.Body, &i, "Item is invalid."); err != nil {
+		log.Error("Item validation failed: ", err)
+		respondWithProblem(w, err, "Item could not be created.")
+		return
+	}
+
+	if err := a.Items.CreateItem(&i); err != nil {
+		log.Error(err)
+		respondWithProblem(w, err, "Item could not be created.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, i)
+}
+
+func (a *App) updateItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Item ID is invalid.")
+		return
+	}
+
+	i := Item{}
+	if err := decodePayload(r.Body, &i, "Item is invalid."); err != nil {
+		log.Error("Item validation failed: ", err)
+		respondWithProblem(w, err, "Item could not be updated.")
+		return
+	}
+	i.ID = id
+
+	if err := a.Items.UpdateItem(&i); err != nil {
 		log.Error(err)
-		if err.Error() == "Order doesn't exist." {
-			respondWithError(w, http.StatusNotFound, "Order doesn't exist.")
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Item not found.")
+		default:
+			respondWithProblem(w, err, "Item could not be updated.")
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, i)
+}
+
+// archiveItem retires an item from new orders. Items are never deleted, so
+// existing orders keep resolving them.
+func (a *App) archiveItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Item ID is invalid.")
+		return
+	}
+
+	if err := a.Items.ArchiveItem(id); err != nil {
+		log.Error(err)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Item not found.")
 			return
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Order could not be deleted.")
+		}
+		respondWithError(w, http.StatusInternalServerError, "Item could not be archived.")
+		return
+	}
+
+	i := Item{ID: id}
+	if err := a.Items.GetItem(&i); err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Item could not be archived.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, i)
+}
+
+// Inventory handlers
+//
+//
+
+func (a *App) getInventory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	storeNo, err := strconv.Atoi(vars["no"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Store number is invalid.")
+		return
+	}
+
+	inventory, err := a.Inventory.GetInventory(storeNo)
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Inventory could not be listed.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, inventory)
+}
+
+func (a *App) setStock(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	storeNo, err := strconv.Atoi(vars["no"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Store number is invalid.")
+		return
+	}
+
+	itemID, err := strconv.Atoi(vars["item"])
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Item ID is invalid.")
+		return
+	}
+
+	var body struct {
+		OnHand int `json:"on_hand"`
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.OnHand < 0 {
+		log.Error("Stock validation failed: ", err)
+		respondWithError(w, http.StatusBadRequest, "Stock is invalid.")
+		return
+	}
+
+	if err := a.Inventory.SetStock(storeNo, itemID, body.OnHand); err != nil {
+		log.Error(err)
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Store or item not found.")
+		default:
+			respondWithProblem(w, err, "Stock could not be set.")
+		}
+		return
+	}
+
+	inventory, err := a.Inventory.GetInventory(storeNo)
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Stock could not be set.")
+		return
+	}
+
+	for _, stock := range inventory {
+		if stock.ItemID == itemID {
+			respondWithJSON(w, http.StatusOK, stock)
 			return
 		}
 	}
-	respondWithJSON(w, http.StatusOK, o)
+	respondWithError(w, http.StatusInternalServerError, "Stock could not be set.")
 }
 
 // Genearal handlers and middleware
@@ -298,28 +862,109 @@ func (a *App) deleteOrder(w http.ResponseWriter, r *http.Request) {
 //
 
 func (a *App) signin(w http.ResponseWriter, r *http.Request) {
-	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Sign-in successful."})
+	tokens, err := issueTokens(a.Sessions, a.TokenSecret, currentUser(r))
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Sign-in failed.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tokens)
 }
 
-func (a *App) basicAuth(fn http.HandlerFunc) http.HandlerFunc {
+func (a *App) signout(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := r.Context().Value(sessionKey).(int)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Sign-out requires a bearer token.")
+		return
+	}
+
+	if err := a.Sessions.RevokeSession(sessionID); err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Sign-out failed.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Sign-out successful."})
+}
+
+func (a *App) refreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.RefreshToken == "" {
+		log.Error(err)
+		respondWithError(w, http.StatusBadRequest, "Refresh token is invalid.")
+		return
+	}
+
+	u, err := a.Sessions.RedeemSession(hashToken(body.RefreshToken))
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized.")
+		return
+	}
+
+	tokens, err := issueTokens(a.Sessions, a.TokenSecret, u)
+	if err != nil {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Token refresh failed.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+// authenticate accepts either a bearer access token or basic credentials.
+// Bearer tokens skip the bcrypt comparison, which is the point of signing in.
+func (a *App) authenticate(fn http.HandlerFunc) http.HandlerFunc {
+	basic := a.basicAuth(fn)
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, password, _ := r.BasicAuth()
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			basic(w, r)
+			return
+		}
 
-		if !userValidations(username, password) {
-			log.Error("User name validation failed.")
-			respondWithError(w, http.StatusBadRequest, "username/password is invalid.")
+		c, err := parseAccessToken(a.TokenSecret, strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			log.Error(err)
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized.")
+			return
+		}
+
+		active, err := a.Sessions.SessionActive(c.SessionID)
+		if err != nil {
+			log.Error(err)
+			respondWithError(w, http.StatusInternalServerError, "Internal server error.")
 			return
 		}
-		result := a.DB.QueryRow("SELECT password FROM users WHERE name=$1", username)
-		if result == nil {
-			log.Error("could not find user: ", username)
+
+		if !active {
+			log.Error("revoked session used by user: ", c.Name)
 			respondWithError(w, http.StatusUnauthorized, "Unauthorized.")
 			return
 		}
 
-		var hashedPassword string
+		ctx := context.WithValue(r.Context(), userKey, User{ID: c.UserID, Name: c.Name, Role: c.Role})
+		ctx = context.WithValue(ctx, sessionKey, c.SessionID)
+		fn(w, r.WithContext(ctx))
+	}
+}
+
+func (a *App) basicAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+
+		if !credentialValidations(username, password) {
+			log.Error("User name validation failed.")
+			respondWithError(w, http.StatusBadRequest, "username/password is invalid.")
+			return
+		}
 
-		err := result.Scan(&hashedPassword)
+		u, hashedPassword, err := a.Users.Credentials(username)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				log.Error(err)
@@ -327,7 +972,7 @@ func (a *App) basicAuth(fn http.HandlerFunc) http.HandlerFunc {
 				return
 			}
 			log.Error(err)
-			respondWithError(w, http.StatusInternalServerError, "Internal server errror.")
+			respondWithError(w, http.StatusInternalServerError, "Internal server error.")
 			return
 		}
 
@@ -336,12 +981,72 @@ func (a *App) basicAuth(fn http.HandlerFunc) http.HandlerFunc {
 			respondWithError(w, http.StatusUnauthorized, "Unauthorized.")
 			return
 		}
-		fn(w, r)
+
+		// Only checked once the password matched, so it does not tell anyone
+		// which names are pending.
+		if !u.Verified {
+			log.Error("unverified user tried to sign in: ", u.Name)
+			respondWithProblem(w, &appError{Code: codeEmailUnverified, Detail: "Email address is not verified."}, "")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey, u)
+		fn(w, r.WithContext(ctx))
+	}
+}
+
+// authorize only lets through principals holding one of the given roles. It
+// must be wrapped by authenticate so the principal is already resolved.
+func (a *App) authorize(fn http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := currentUser(r)
+		for _, role := range roles {
+			if u.Role == role {
+				fn(w, r)
+				return
+			}
+		}
+
+		log.Error("role ", u.Role, " is not allowed for user: ", u.Name)
+		respondWithError(w, http.StatusForbidden, "Forbidden.")
 	}
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+// currentUser returns the principal resolved by the auth middleware.
+func currentUser(r *http.Request) User {
+	u, _ := r.Context().Value(userKey).(User)
+	return u
+}
+
+// orderETag is the entity tag of the order's current version.
+func orderETag(o Order) string {
+	return `"` + strconv.Itoa(o.Version) + `"`
+}
+
+// ifMatch returns the order version a write is conditional on, and false when
+// there is no If-Match header. "*" matches any version and is returned as 0;
+// tags that are not ours, weak ones included, are returned as -1 so they never
+// match.
+func ifMatch(r *http.Request) (int, bool) {
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" {
+		return 0, false
+	}
+
+	if tag == "*" {
+		return 0, true
+	}
+
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return -1, true
+	}
+
+	version, err := strconv.Atoi(tag[1 : len(tag)-1])
+	if err != nil || version < 1 {
+		return -1, true
+	}
+
+	return version, true
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
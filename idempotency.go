@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const idempotencyKeyTTL = 24 * time.Hour
+
+// IdempotentRequest is what is stored for an Idempotency-Key: a hash of the
+// request it was first used with and, once it completed, the response.
+type IdempotentRequest struct {
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent lets clients retry a request safely by sending an
+// Idempotency-Key header. The first response for a key is stored and replayed
+// for retries with the same body; reusing the key for a different body is
+// rejected. Server errors and panics are not stored, so those can be retried.
+// It must be wrapped by authenticate, as keys are scoped to the user.
+func (a *App) idempotent(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			fn(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			respondWithError(w, http.StatusBadRequest, "Idempotency-Key is invalid.")
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Error(err)
+			respondWithError(w, http.StatusBadRequest, "Request body could not be read.")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		userID := currentUser(r).ID
+		requestHash := hashToken(r.Method + " " + r.URL.Path + "\n" + string(body))
+
+		stored, claimed, err := a.Idempotency.BeginIdempotent(userID, key, requestHash)
+		if err != nil {
+			log.Error(err)
+			respondWithError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+
+		if !claimed {
+			switch {
+			case stored.RequestHash != requestHash:
+				log.Error("Idempotency-Key reused with a different request by user: ", userID)
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request.")
+			case stored.StatusCode == 0:
+				respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress.")
+			default:
+				contentType := "application/json"
+				if stored.StatusCode >= http.StatusBadRequest {
+					contentType = problemContentType
+				}
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		// A panic would otherwise leave the key claimed until it expires, and
+		// every retry would be told the request is still in progress.
+		defer func() {
+			if p := recover(); p != nil {
+				if err := a.Idempotency.AbandonIdempotent(userID, key); err != nil {
+					log.Error("abandoning the idempotent request failed: ", err)
+				}
+				panic(p)
+			}
+		}()
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		fn(recorder, r)
+
+		if recorder.code == 0 || recorder.code >= http.StatusInternalServerError {
+			err = a.Idempotency.AbandonIdempotent(userID, key)
+		} else {
+			err = a.Idempotency.CompleteIdempotent(userID, key, recorder.code, recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Error("storing the idempotent response failed: ", err)
+		}
+	}
+}
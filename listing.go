@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOrderLimit = 10
+	maxOrderLimit     = 100
+)
+
+// OrderPage is the response of an order listing. NextCursor is left out on
+// the last page.
+type OrderPage struct {
+	Orders     Orders `json:"orders"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageCursor is what an opaque cursor encodes. The sort is kept so a cursor
+// can not be used to continue a listing sorted differently.
+type pageCursor struct {
+	Sort string `json:"s"`
+	OrderCursor
+}
+
+func encodeCursor(sort string, c *OrderCursor) string {
+	b, _ := json.Marshal(pageCursor{sort, *c})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(sort, cursor string) (*OrderCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalidField("cursor", "Cursor is invalid.")
+	}
+
+	var c pageCursor
+	if err = json.Unmarshal(b, &c); err != nil || c.ID < 1 {
+		return nil, invalidField("cursor", "Cursor is invalid.")
+	}
+
+	if c.Sort != sort {
+		return nil, invalidField("cursor", "Cursor is for a different sort.")
+	}
+
+	return &c.OrderCursor, nil
+}
+
+// parseOrderQuery reads the parameters of GET /orders. count and start are
+// still accepted as aliases of limit and an offset, for older clients, and
+// are corrected rather than rejected as they always were: a count below 1 is
+// the default, one above the maximum is the maximum and a negative start is 0.
+func parseOrderQuery(v url.Values) (OrderQuery, error) {
+	q := OrderQuery{Limit: defaultOrderLimit, Sort: sortNewest}
+
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxOrderLimit {
+			return q, invalidField("limit", "Limit must be between 1 and "+strconv.Itoa(maxOrderLimit)+".")
+		}
+		q.Limit = n
+	} else if count, _ := strconv.Atoi(v.Get("count")); count > maxOrderLimit {
+		q.Limit = maxOrderLimit
+	} else if count > 0 {
+		q.Limit = count
+	}
+
+	if start, _ := strconv.Atoi(v.Get("start")); start > 0 {
+		q.Offset = start
+	}
+
+	if sort := v.Get("sort"); sort != "" {
+		if !validSort(sort) {
+			return q, invalidField("sort", "Sort must be one of created_at, -created_at, total or -total.")
+		}
+		q.Sort = sort
+	}
+
+	for _, value := range v["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if !validStatus(status) {
+				return q, invalidField("status", "Status is invalid.")
+			}
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+
+	var err error
+	if q.From, err = parseDate(v.Get("from")); err != nil {
+		return q, invalidField("from", "From must be a date or an RFC 3339 time.")
+	}
+	if q.To, err = parseDate(v.Get("to")); err != nil {
+		return q, invalidField("to", "To must be a date or an RFC 3339 time.")
+	}
+
+	if item := v.Get("item"); item != "" {
+		if q.ItemID, err = strconv.Atoi(item); err != nil || q.ItemID < 1 {
+			return q, invalidField("item", "Item is invalid.")
+		}
+	}
+
+	if cursor := v.Get("cursor"); cursor != "" {
+		if q.After, err = decodeCursor(q.Sort, cursor); err != nil {
+			return q, err
+		}
+	}
+
+	return q, nil
+}
+
+// parseDate accepts a plain date, meaning midnight UTC, or an RFC 3339 time.
+// An empty value is the zero time.
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// nextPageURL is the request URL continuing from the cursor, for the Link
+// header.
+func nextPageURL(u *url.URL, cursor string) string {
+	v := u.Query()
+	v.Del("start")
+	v.Set("cursor", cursor)
+
+	next := url.URL{Path: u.Path, RawQuery: v.Encode()}
+	return next.String()
+}
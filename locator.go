@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/prometheus/common/log"
+)
+
+// StoreLocator finds candidate stores for a zipcode.
+type StoreLocator interface {
+	Locate(zipcode int) ([]Store, error)
+}
+
+// newStoreLocator picks the offline catalog when FRANKLIN_STORE_CATALOG points
+// at one, and falls back to the Walmart Open API otherwise.
+func newStoreLocator() StoreLocator {
+	if path := os.Getenv("FRANKLIN_STORE_CATALOG"); path != "" {
+		catalog, err := NewCatalogLocator(path)
+		if err != nil {
+			log.Fatal("store catalog could not be loaded: ", err)
+		}
+		log.Info("using offline store catalog: ", path)
+		return catalog
+	}
+
+	apiKey := os.Getenv("WALMART_OPEN_API_KEY")
+	if apiKey == "" {
+		log.Error("WALMART_OPEN_API_KEY is not set.")
+	}
+
+	return &WalmartLocator{APIKey: apiKey}
+}
+
+// WalmartLocator queries the Walmart Open API stores endpoint.
+type WalmartLocator struct {
+	APIKey string
+}
+
+func (l *WalmartLocator) Locate(zipcode int) ([]Store, error) {
+	url := fmt.Sprintf("http://api.walmartlabs.com/v1/stores?apiKey=%s&zip=%s&format=json", l.APIKey, strconv.Itoa(zipcode))
+
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var stores []Store
+	err = json.NewDecoder(resp.Body).Decode(&stores)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return stores, nil
+}
+
+// CatalogLocator serves stores from a local CSV catalog, so signup works
+// without network access. The CSV header is:
+//
+//	no,name,streetAddress,city,stateProvCode,zip,country,phoneNumber,sundayOpen,timezone,longitude,latitude
+type CatalogLocator struct {
+	stores []Store
+}
+
+func NewCatalogLocator(path string) (*CatalogLocator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readCatalog(f)
+}
+
+func readCatalog(r io.Reader) (*CatalogLocator, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) < 2 {
+		return nil, errors.New("Store catalog is empty.")
+	}
+
+	l := &CatalogLocator{}
+	for line, record := range records[1:] {
+		s, err := parseCatalogRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("store catalog line %d: %v", line+2, err)
+		}
+		l.stores = append(l.stores, s)
+	}
+
+	return l, nil
+}
+
+func parseCatalogRecord(record []string) (Store, error) {
+	if len(record) != 12 {
+		return Store{}, fmt.Errorf("expected 12 fields, got %d", len(record))
+	}
+
+	no, err := strconv.Atoi(record[0])
+	if err != nil {
+		return Store{}, err
+	}
+
+	sundayOpen, err := strconv.ParseBool(record[8])
+	if err != nil {
+		return Store{}, err
+	}
+
+	lon, err := strconv.ParseFloat(record[10], 64)
+	if err != nil {
+		return Store{}, err
+	}
+
+	lat, err := strconv.ParseFloat(record[11], 64)
+	if err != nil {
+		return Store{}, err
+	}
+
+	return Store{
+		No:            no,
+		Name:          record[1],
+		StreetAddress: record[2],
+		City:          record[3],
+		StateProvCode: record[4],
+		Zip:           record[5],
+		Country:       record[6],
+		PhoneNumber:   record[7],
+		SundayOpen:    sundayOpen,
+		Timezone:      record[9],
+		Coordinates:   []float64{lon, lat},
+	}, nil
+}
+
+// Locate returns the stores in the same zipcode, or failing that the stores
+// sharing its three digit prefix (the USPS sectional center).
+func (l *CatalogLocator) Locate(zipcode int) ([]Store, error) {
+	zip := fmt.Sprintf("%05d", zipcode)
+
+	var exact, sectional []Store
+	for _, s := range l.stores {
+		if s.Zip == zip {
+			exact = append(exact, s)
+		} else if len(s.Zip) >= 3 && s.Zip[:3] == zip[:3] {
+			sectional = append(sectional, s)
+		}
+	}
+
+	if len(exact) > 0 {
+		return exact, nil
+	}
+	return sectional, nil
+}
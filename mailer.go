@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const defaultMailFrom = "Franklin <no-reply@localhost>"
+
+// Mail is a plain text email to a single recipient.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mail. Sending is part of handling a request, so
+// implementations should not block for long.
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// newMailer picks the mailer from the environment: SMTP when
+// FRANKLIN_SMTP_ADDR is set, else a file when FRANKLIN_MAIL_FILE is, else the
+// log, which is enough to follow verification links locally.
+func newMailer() Mailer {
+	from := os.Getenv("FRANKLIN_MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		log.Fatal("FRANKLIN_MAIL_FROM must be an email address: ", from)
+	}
+
+	if addr := os.Getenv("FRANKLIN_SMTP_ADDR"); addr != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Fatal("FRANKLIN_SMTP_ADDR must be a host:port: ", addr)
+		}
+
+		m := &smtpMailer{Addr: addr, From: sender}
+		if user := os.Getenv("FRANKLIN_SMTP_USER"); user != "" {
+			m.Auth = smtp.PlainAuth("", user, os.Getenv("FRANKLIN_SMTP_PASSWORD"), host)
+		}
+		return m
+	}
+
+	if path := os.Getenv("FRANKLIN_MAIL_FILE"); path != "" {
+		return &fileMailer{Path: path, From: sender}
+	}
+
+	log.Info("FRANKLIN_SMTP_ADDR is not set, mail is only logged.")
+	return logMailer{}
+}
+
+// message formats the mail as an RFC 5322 message.
+func (m Mail) message(from *mail.Address) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(m.Body)
+	return b.Bytes()
+}
+
+// smtpMailer sends through an SMTP relay. Auth is nil for relays that do not
+// require it.
+type smtpMailer struct {
+	Addr string
+	From *mail.Address
+	Auth smtp.Auth
+}
+
+func (s *smtpMailer) Send(m Mail) error {
+	return smtp.SendMail(s.Addr, s.Auth, s.From.Address, []string{m.To}, m.message(s.From))
+}
+
+// fileMailer appends every message to a file instead of sending it, for local
+// testing.
+type fileMailer struct {
+	Path string
+	From *mail.Address
+
+	mu sync.Mutex
+}
+
+func (f *fileMailer) Send(m Mail) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(m.message(f.From), "\r\n\r\n"...)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// logMailer only logs mail, for development without any mail setup.
+type logMailer struct{}
+
+func (logMailer) Send(m Mail) error {
+	log.Info("mail to ", m.To, ": ", m.Subject, "\n", m.Body)
+	return nil
+}
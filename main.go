@@ -2,7 +2,11 @@ package main
 
 import (
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/common/log"
 )
@@ -11,12 +15,70 @@ func main() {
 
 	a := App{}
 
-	err := a.InitDB("franklin.db")
+	driver := os.Getenv("FRANKLIN_DB_DRIVER")
+	if driver == "" {
+		driver = "sqlite3"
+	}
+
+	dataSource := os.Getenv("FRANKLIN_DB_SOURCE")
+	if dataSource == "" {
+		dataSource = "franklin.db"
+	}
+
+	// `migrate` works on the schema as it is, the server migrates it first.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := a.OpenDB(driver, dataSource); err != nil {
+			log.Fatal("Database initialization failed:", err)
+		}
+		migrate(a, os.Args[2:])
+		return
+	}
+
+	err := a.InitDB(driver, dataSource)
 	if err != nil {
 		log.Fatal("Database initialization failed:", err)
 	}
 
 	a.InitRouter()
 
+	go a.purgeOrders(time.Hour)
+
 	log.Fatal(http.ListenAndServe(":8080", a.Router))
 }
+
+// migrate runs `Franklin migrate [up|down [steps]|status]`.
+func migrate(a App, args []string) {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		if err := migrateUp(a.DB, a.Dialect); err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatal("migrate down expects a positive number of steps.")
+			}
+			steps = n
+		}
+
+		if err := migrateDown(a.DB, a.Dialect, steps); err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+	default:
+		log.Fatal("unknown migrate command: ", command)
+	}
+
+	version, err := schemaVersion(a.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Info("schema version: ", version, " of ", len(migrations))
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -18,23 +26,19 @@ import (
 var a App
 
 func TestMain(m *testing.M) {
-	a = App{}
-	a.InitDB("franklin-test.db")
-	a.InitRouter()
+	catalog, err := NewCatalogLocator("data/stores.csv")
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	query :=
-		`CREATE TABLE IF NOT EXISTS users (
-    id INTEGER AUTO_INCREMENT PRIMARY KEY,
-    name VARCHAR(255) NOT NULL,
-    password TEXT NOT NULL,
-    zip INTEGER,
-    store_lat REAL,
-    store_lon REAL
-)`
-
-	if _, err := a.DB.Exec(query); err != nil {
+	// The test database is rebuilt from the migrations on every run.
+	os.Remove("franklin-test.db")
+
+	a = App{StoreLocator: catalog, Mailer: mailed}
+	if err := a.InitDB("sqlite3", "franklin-test.db"); err != nil {
 		log.Fatal(err)
 	}
+	a.InitRouter()
 
 	code := m.Run()
 
@@ -42,6 +46,10 @@ func TestMain(m *testing.M) {
 	clearOrdersTable()
 	clearOrderItemsTable()
 	clearItemsTable()
+	clearRefreshTokensTable()
+	clearInventoryTable()
+	clearIdempotencyKeysTable()
+	clearStoresTable()
 
 	os.Exit(code)
 }
@@ -51,6 +59,7 @@ func TestUserIDDoesNotExist(t *testing.T) {
 	clearUsersTable()
 
 	setAuthentication()
+	setAdmin("Test User")
 
 	req, _ := http.NewRequest("GET", "/users/15", nil)
 
@@ -59,9 +68,7 @@ func TestUserIDDoesNotExist(t *testing.T) {
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
-	actual := string(response.Body.Bytes())
-
-	assert.JSONEq(t, `{"error":"User not found."}`, actual)
+	assertProblem(t, response, codeNotFound, "User not found.")
 
 	assert.Equal(t, response.Code, http.StatusNotFound)
 }
@@ -89,11 +96,95 @@ func TestGetUser(t *testing.T) {
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"id":1,"name":"Test User","closest_store":{"coordinates":[22.33,44.55]}}`, actual)
+	assert.JSONEq(t, `{"id":1,"name":"Test User","role":"user","closest_store":{"coordinates":[22.33,44.55]}}`, actual)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+}
+
+func TestGetOtherUser(t *testing.T) {
+	clearUsersTable()
+
+	setAuthentication()
+	insertUser("Other User")
+
+	req, _ := http.NewRequest("GET", "/users/2", nil)
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeForbidden, "Forbidden.")
+
+	assert.Equal(t, response.Code, http.StatusForbidden)
+}
+
+func TestAdminGetOtherUser(t *testing.T) {
+	clearUsersTable()
+
+	setAuthentication()
+	setAdmin("Test User")
+	insertUser("Other User")
+
+	_, err := a.DB.Exec("UPDATE users SET store_lat=22.33, store_lon=44.55 WHERE id=2")
+	if err != nil {
+		log.Error(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/users/2", nil)
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	actual := string(response.Body.Bytes())
+
+	assert.JSONEq(t, `{"id":2,"name":"Other User","role":"user","closest_store":{"coordinates":[22.33,44.55]}}`, actual)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+}
+
+func TestAdminGetUsers(t *testing.T) {
+	clearUsersTable()
+
+	setAuthentication()
+	setAdmin("Test User")
+	insertUser("Other User")
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	actual := string(response.Body.Bytes())
+
+	assert.JSONEq(t, `[{"id":1,"name":"Test User","role":"admin","closest_store":{}},{"id":2,"name":"Other User","role":"user","closest_store":{}}]`, actual)
 
 	assert.Equal(t, response.Code, http.StatusOK)
 }
 
+func TestGetUsersForbidden(t *testing.T) {
+	clearUsersTable()
+	clearRefreshTokensTable()
+
+	setAuthentication()
+
+	tokens := signin(t)
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeForbidden, "Forbidden.")
+
+	assert.Equal(t, response.Code, http.StatusForbidden)
+}
+
 func TestSignInUnauthorized(t *testing.T) {
 	clearUsersTable()
 
@@ -106,9 +197,7 @@ func TestSignInUnauthorized(t *testing.T) {
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
-	actual := string(response.Body.Bytes())
-
-	assert.JSONEq(t, `{"error":"Unauthorized."}`, actual)
+	assertProblem(t, response, codeUnauthorized, "Unauthorized.")
 
 	assert.Equal(t, response.Code, http.StatusUnauthorized)
 
@@ -126,12 +215,155 @@ func TestSigninAuthorized(t *testing.T) {
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
+	tokens := Tokens{}
+	err := json.Unmarshal(response.Body.Bytes(), &tokens)
+	assert.NoError(t, err)
+
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, 900, tokens.ExpiresIn)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+
+}
+
+func TestBearerTokenAuthorized(t *testing.T) {
+	clearUsersTable()
+	clearRefreshTokensTable()
+
+	setAuthentication()
+
+	_, err := a.DB.Exec("UPDATE users SET store_lat=22.33, store_lon=44.55 WHERE id=1")
+	if err != nil {
+		log.Error(err)
+	}
+
+	tokens := signin(t)
+
+	req, _ := http.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"message":"Sign-in successful."}`, actual)
+	assert.JSONEq(t, `{"id":1,"name":"Test User","role":"user","closest_store":{"coordinates":[22.33,44.55]}}`, actual)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+}
+
+func TestBearerTokenTampered(t *testing.T) {
+	clearUsersTable()
+	clearRefreshTokensTable()
+
+	setAuthentication()
+
+	tokens := signin(t)
+
+	forged, err := signAccessToken([]byte("not-the-secret"), claims{UserID: 1, Name: "Test User", SessionID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+
+	for _, token := range []string{forged, tokens.AccessToken + "x", "garbage"} {
+		req, _ := http.NewRequest("GET", "/users/1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+
+		assertProblem(t, response, codeUnauthorized, "Unauthorized.")
+		assert.Equal(t, response.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestBearerTokenExpired(t *testing.T) {
+	clearUsersTable()
+	clearRefreshTokensTable()
+
+	setAuthentication()
+
+	signin(t)
+
+	expired, err := signAccessToken(a.TokenSecret, claims{UserID: 1, Name: "Test User", SessionID: 1, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("Authorization", "Bearer "+expired)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeUnauthorized, "Unauthorized.")
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+}
+
+func TestRefreshToken(t *testing.T) {
+	clearUsersTable()
+	clearRefreshTokensTable()
+
+	setAuthentication()
+
+	tokens := signin(t)
+
+	jsonStr := []byte(fmt.Sprintf(`{"refresh_token":"%s"}`, tokens.RefreshToken))
+
+	req, _ := http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(jsonStr))
 
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	refreshed := Tokens{}
+	err := json.Unmarshal(response.Body.Bytes(), &refreshed)
+	assert.NoError(t, err)
+
+	assert.NotEmpty(t, refreshed.AccessToken)
+	assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	// Refresh tokens rotate, so the original can not be redeemed twice.
+	req, _ = http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(jsonStr))
+
+	response = httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeUnauthorized, "Unauthorized.")
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+}
+
+func TestSignoutRevokesToken(t *testing.T) {
+	clearUsersTable()
+	clearRefreshTokensTable()
+
+	setAuthentication()
+
+	tokens := signin(t)
+
+	req, _ := http.NewRequest("POST", "/signout", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assert.JSONEq(t, `{"message":"Sign-out successful."}`, string(response.Body.Bytes()))
 	assert.Equal(t, response.Code, http.StatusOK)
 
+	req, _ = http.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+	response = httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeUnauthorized, "Unauthorized.")
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+
+	jsonStr := []byte(fmt.Sprintf(`{"refresh_token":"%s"}`, tokens.RefreshToken))
+	req, _ = http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(jsonStr))
+
+	response = httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
 }
 
 func TestUserInvalidName(t *testing.T) {
@@ -139,7 +371,7 @@ func TestUserInvalidName(t *testing.T) {
 
 	setAuthentication()
 
-	str := fmt.Sprintf(`{"name":"%s", "password": "new-password", "zipcode": 78704}"`, randSeq(256))
+	str := fmt.Sprintf(`{"name":"%s", "email": "test@example.com", "password": "new-password", "zipcode": 78704}`, randSeq(256))
 	jsonStr := []byte(str)
 
 	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
@@ -147,9 +379,8 @@ func TestUserInvalidName(t *testing.T) {
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
-	actual := string(response.Body.Bytes())
-
-	assert.JSONEq(t, `{"error":"username/password is invalid."}`, actual)
+	assertProblem(t, response, codeValidation, "User is invalid.")
+	assert.Contains(t, response.Body.String(), `{"field":"name","message":"must be at most 254 characters"}`)
 
 	assert.Equal(t, response.Code, http.StatusBadRequest)
 
@@ -160,6 +391,10 @@ func TestCreateUser(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
+	locator := a.StoreLocator
+	a.StoreLocator = &WalmartLocator{APIKey: "fake-key"}
+	defer func() { a.StoreLocator = locator }()
+
 	fakeResponseJson := []byte(`[
 	{
 	"no": 1253,
@@ -199,7 +434,7 @@ func TestCreateUser(t *testing.T) {
 
 	clearUsersTable()
 
-	jsonStr := []byte(`{"name":"Test User", "password": "new-password", "zipcode": 78704}`)
+	jsonStr := []byte(`{"name":"Test User", "email": "test@example.com", "password": "new-password", "role": "admin", "zipcode": 78704}`)
 
 	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
 
@@ -208,67 +443,54 @@ func TestCreateUser(t *testing.T) {
 
 	actual := string(response.Body.Bytes())
 
-	expected := `{"id":1,"name":"Test User","zipcode":78704,"closest_store":{"city":"Austin","coordinates":[-97.753926,30.221033],"country":"US","name":"Fake Supercenter","no":1253,"phoneNumber":"512-443-6601","stateProvCode":"TX","streetAddress":"710 E Ben White Blvd","sundayOpen":true,"timezone":"CST","zip":"78704"}}`
+	expected := `{"id":1,"name":"Test User","email":"test@example.com","role":"user","zipcode":78704,"closest_store":{"city":"Austin","coordinates":[-97.753926,30.221033],"country":"US","distance":1.67,"name":"Fake Supercenter","no":1253,"phoneNumber":"512-443-6601","stateProvCode":"TX","streetAddress":"710 E Ben White Blvd","sundayOpen":true,"timezone":"CST","zip":"78704"}}`
 
 	assert.JSONEq(t, expected, actual)
 
 	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func TestOrderIDDoesNotExist(t *testing.T) {
+func TestCreateUserOfflineCatalog(t *testing.T) {
 	clearUsersTable()
-	clearOrdersTable()
 
-	setAuthentication()
-	req, _ := http.NewRequest("GET", "/orders/15?user_id=1", nil)
+	jsonStr := []byte(`{"name":"Test User", "email": "test@example.com", "password": "new-password", "zipcode": 78704}`)
 
-	req.SetBasicAuth("Test User", "correct-password")
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
 
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"error":"Order not found."}`, actual)
+	expected := `{"id":1,"name":"Test User","email":"test@example.com","role":"user","zipcode":78704,"closest_store":{"city":"Austin","coordinates":[-97.753926,30.221033],"country":"US","distance":1.67,"name":"Austin Supercenter","no":1253,"phoneNumber":"512-443-6601","stateProvCode":"TX","streetAddress":"710 E Ben White Blvd","sundayOpen":true,"timezone":"CST","zip":"78704"}}`
 
-	assert.Equal(t, response.Code, http.StatusNotFound)
+	assert.JSONEq(t, expected, actual)
 
+	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func TestGetOrder(t *testing.T) {
+func TestGetUserFullStore(t *testing.T) {
 	clearUsersTable()
-	clearOrdersTable()
-	clearOrderItemsTable()
-	clearItemsTable()
+	clearStoresTable()
 
-	setAuthentication()
+	// Signing up twice near the same store only keeps one copy of it.
+	for _, name := range []string{"Test User", "Other User"} {
+		email := strings.ToLower(strings.Fields(name)[0]) + "@example.com"
+		jsonStr := []byte(fmt.Sprintf(`{"name":"%s", "email": "%s", "password": "correct-password", "zipcode": 78704}`, name, email))
 
-	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
-	if err != nil {
-		log.Error(err)
-	}
+		req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
-	if err != nil {
-		log.Error(err)
-	}
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
-	if err != nil {
-		log.Error(err)
+		assert.Equal(t, response.Code, http.StatusOK)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
-	if err != nil {
-		log.Error(err)
-	}
+	assert.Equal(t, 1, countRows("stores"))
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 2)")
-	if err != nil {
-		log.Error(err)
-	}
+	followVerification(&a, "test@example.com")
 
-	req, _ := http.NewRequest("GET", "/orders/1?user_id=1", nil)
+	req, _ := http.NewRequest("GET", "/users/1", nil)
 
 	req.SetBasicAuth("Test User", "correct-password")
 
@@ -277,163 +499,262 @@ func TestGetOrder(t *testing.T) {
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":0,"items":[{"id":1,"name":"apple"},{"id":2,"name":"oranges"}]}`, actual)
+	expected := `{"id":1,"name":"Test User","email":"test@example.com","role":"user","closest_store":{"city":"Austin","coordinates":[-97.753926,30.221033],"country":"US","distance":1.67,"name":"Austin Supercenter","no":1253,"phoneNumber":"512-443-6601","stateProvCode":"TX","streetAddress":"710 E Ben White Blvd","sundayOpen":true,"timezone":"CST","zip":"78704"}}`
+
+	assert.JSONEq(t, expected, actual)
 
 	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func TestGetOrderOfOtherUser(t *testing.T) {
+func TestEmailVerification(t *testing.T) {
 	clearUsersTable()
-	clearOrdersTable()
-	clearOrderItemsTable()
-	clearItemsTable()
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("correct-password"), 8)
-	if err != nil {
-		log.Error(err)
-	}
 
-	statement := fmt.Sprintf(`INSERT INTO users(name,password) VALUES('%s', '%s')`, "First User", hashedPassword)
-	_, err = a.DB.Exec(statement)
-	if err != nil {
-		log.Error(err)
-	}
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("New User", "correct-password")
 
-	statement = fmt.Sprintf(`INSERT INTO users(name,password) VALUES('%s', '%s')`, "Attacker User", hashedPassword)
-	_, err = a.DB.Exec(statement)
-	if err != nil {
-		log.Error(err)
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
 	}
 
-	_, err = a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
-	if err != nil {
-		log.Error(err)
-	}
+	response := send("POST", "/users", `{"name": "New User", "email": "new@example.com", "password": "correct-password", "zipcode": 78704}`)
+	assert.Equal(t, http.StatusOK, response.Code)
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
-	if err != nil {
-		log.Error(err)
-	}
+	message, ok := mailed.last("new@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "Verify your email address", message.Subject)
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
-	if err != nil {
-		log.Error(err)
-	}
+	link := mailed.link("new@example.com")
+	assert.True(t, strings.HasPrefix(link, "http://localhost:8080/users/verify?token="))
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
-	if err != nil {
-		log.Error(err)
-	}
+	// Pending accounts can not sign in until they followed the link.
+	response = send("POST", "/signin", "")
+	assertProblem(t, response, codeEmailUnverified, "Email address is not verified.")
+	assert.Equal(t, http.StatusForbidden, response.Code)
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 2)")
-	if err != nil {
-		log.Error(err)
-	}
-	req, _ := http.NewRequest("GET", "/orders/1?user_id=2", nil)
+	response = send("POST", "/users", `{"name": "Other User", "email": "new@example.com", "password": "correct-password", "zipcode": 78704}`)
+	assertProblem(t, response, codeDuplicateEmail, "Email address is already registered.")
+	assert.Equal(t, 1, countRows("users"))
 
-	req.SetBasicAuth("Attacker User", "correct-password")
+	// Links that are forged, meant for another address or not meant for
+	// verification at all are refused.
+	response = send("GET", strings.Replace(link, "token=", "token=x", 1), "")
+	assertProblem(t, response, codeInvalidVerification, "Verification link is invalid.")
 
-	response := httptest.NewRecorder()
-	a.Router.ServeHTTP(response, req)
+	other, _ := signToken(a.TokenSecret, verificationPurpose, verification{UserID: 1, Email: "old@example.com", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	response = send("GET", "/users/verify?token="+other, "")
+	assertProblem(t, response, codeInvalidVerification, "Verification link is invalid.")
 
-	actual := string(response.Body.Bytes())
+	access, _ := signAccessToken(a.TokenSecret, claims{UserID: 1, Name: "New User", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	response = send("GET", "/users/verify?token="+access, "")
+	assertProblem(t, response, codeInvalidVerification, "Verification link is invalid.")
 
-	assert.JSONEq(t, `{"error":"Order not found."}`, actual)
+	expired, _ := signToken(a.TokenSecret, verificationPurpose, verification{UserID: 1, Email: "new@example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	response = send("GET", "/users/verify?token="+expired, "")
+	assertProblem(t, response, codeVerificationExpired, "Verification link expired, request a new one.")
 
-	assert.Equal(t, response.Code, http.StatusNotFound)
-}
+	// A new link can be requested while the account is pending.
+	response = send("POST", "/users/verify", `{"email": "new@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, 2, mailed.count("new@example.com"))
 
-func TestCreateOrder(t *testing.T) {
+	response = send("GET", link, "")
+	assert.JSONEq(t, `{"message":"Email address verified."}`, response.Body.String())
+	assert.Equal(t, http.StatusOK, response.Code)
 
-	clearUsersTable()
-	clearOrdersTable()
-	clearOrderItemsTable()
-	clearItemsTable()
+	response = send("POST", "/signin", "")
+	assert.Equal(t, http.StatusOK, response.Code)
 
-	setAuthentication()
+	// Following the link twice is harmless, and verified accounts get no new
+	// links, without telling the address apart from unknown ones.
+	response = send("GET", link, "")
+	assert.Equal(t, http.StatusOK, response.Code)
 
-	jsonStr := []byte(`{"user":"Test User", "user_id": 1, "items": [{"id": 1, "name": "Apples"}, {"id": 2, "name": "Oranges"}]}`)
+	response = send("POST", "/users/verify", `{"email": "new@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	response = send("POST", "/users/verify", `{"email": "nobody@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Equal(t, 2, mailed.count("new@example.com"))
 
-	req, _ := http.NewRequest("POST", "/orders", bytes.NewBuffer(jsonStr))
+	response = send("POST", "/users/verify", `{"email": "nobody"}`)
+	assertProblem(t, response, codeValidation, "Email address is invalid.")
 
-	req.SetBasicAuth("Test User", "correct-password")
+	// Browsers can be sent on to a page of the shop.
+	a.VerifiedRedirect = "https://shop.example.com/welcome"
+	defer func() { a.VerifiedRedirect = "" }()
 
-	response := httptest.NewRecorder()
-	a.Router.ServeHTTP(response, req)
+	response = send("GET", link, "")
+	assert.Equal(t, http.StatusSeeOther, response.Code)
+	assert.Equal(t, "https://shop.example.com/welcome", response.Header().Get("Location"))
+}
 
-	actual := string(response.Body.Bytes())
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "franklin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
 
-	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"Apples"},{"id":2,"name":"Oranges"}]}`, actual)
+	m := &fileMailer{Path: filepath.Join(dir, "mail.txt"), From: &mail.Address{Name: "Franklin", Address: "no-reply@example.com"}}
+	assert.NoError(t, m.Send(Mail{To: "first@example.com", Subject: "First", Body: "Hello"}))
+	assert.NoError(t, m.Send(Mail{To: "second@example.com", Subject: "Second", Body: "Hello again"}))
 
-	assert.Equal(t, response.Code, http.StatusOK)
+	content, err := ioutil.ReadFile(m.Path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "From: \"Franklin\" <no-reply@example.com>\r\nTo: first@example.com\r\nSubject: First\r\n")
+	assert.Contains(t, string(content), "To: second@example.com\r\nSubject: Second\r\n")
+	assert.Contains(t, string(content), "\r\n\r\nHello again")
 }
 
-func TestGetOrders(t *testing.T) {
+func TestCreateUserNoStoreNearby(t *testing.T) {
 	clearUsersTable()
-	clearOrdersTable()
-	clearOrderItemsTable()
 
-	setAuthentication()
+	jsonStr := []byte(`{"name":"Test User", "email": "test@example.com", "password": "new-password", "zipcode": 10001}`)
 
-	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
-	if err != nil {
-		log.Error(err)
-	}
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
 
-	_, err = a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
-	if err != nil {
-		log.Error(err)
-	}
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
-	if err != nil {
-		log.Error(err)
-	}
+	assertProblem(t, response, codeInternal, "User could not be created.")
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
-	if err != nil {
-		log.Error(err)
-	}
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+}
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
-	if err != nil {
-		log.Error(err)
-	}
+func TestCreateUserNearestStore(t *testing.T) {
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
-	if err != nil {
-		log.Error(err)
-	}
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 2)")
-	if err != nil {
-		log.Error(err)
-	}
+	locator := a.StoreLocator
+	a.StoreLocator = &WalmartLocator{APIKey: "fake-key"}
+	defer func() { a.StoreLocator = locator }()
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 1)")
-	if err != nil {
-		log.Error(err)
-	}
+	// The API lists the farther store first.
+	fakeResponseJson := []byte(`[
+	{"no": 1253, "name": "Fake Supercenter", "coordinates": [-97.753926, 30.221033], "zip": "78704"},
+	{"no": 2133, "name": "Fake Supercenter", "coordinates": [-97.8232981, 30.2322111], "zip": "78735"}
+	]`)
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 3)")
-	if err != nil {
-		log.Error(err)
-	}
-	req, _ := http.NewRequest("GET", "/orders?user_id=1&count=10&start=0", nil)
+	url := "http://api.walmartlabs.com/v1/stores"
+	httpmock.RegisterResponder("GET", url, httpmock.NewBytesResponder(http.StatusOK, fakeResponseJson))
 
-	req.SetBasicAuth("Test User", "correct-password")
+	clearUsersTable()
+
+	jsonStr := []byte(`{"name":"Test User", "email": "test@example.com", "password": "new-password", "zipcode": 78735}`)
+
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
 
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `[{"id":2,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple"},{"id":3,"name":"avacado"}]},{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple"},{"id":2,"name":"oranges"}]}]`, actual)
+	expected := `{"id":1,"name":"Test User","email":"test@example.com","role":"user","zipcode":78735,"closest_store":{"coordinates":[-97.8232981,30.2322111],"distance":3.21,"name":"Fake Supercenter","no":2133,"zip":"78735"}}`
+
+	assert.JSONEq(t, expected, actual)
 
 	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func TestUpdateOrder(t *testing.T) {
+func TestClosestStore(t *testing.T) {
+	// 78745 has no store of its own; the nearest in its sectional center is not the first listed.
+	store, err := a.closestStore(78745)
+	assert.NoError(t, err)
+	assert.Equal(t, 2133, store.No)
+	assert.Equal(t, 2.4, store.Distance)
+
+	// Without a centroid there is no closest store, rather than an arbitrary one.
+	_, err = a.closestStore(78799)
+	assert.Equal(t, &appError{Code: codeValidation, Detail: "User is invalid.", Fields: []fieldError{{"zipcode", "is not a known ZIP code"}}}, err)
+}
+
+func TestCreateUserUnknownZipcode(t *testing.T) {
+	clearUsersTable()
+
+	jsonStr := []byte(`{"name":"Test User", "email": "test@example.com", "password": "new-password", "zipcode": 78799}`)
+
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeValidation, "User is invalid.")
+	assert.Contains(t, response.Body.String(), `{"field":"zipcode","message":"is not a known ZIP code"}`)
+
+	var count int
+	assert.NoError(t, a.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestReadZipcodesGazetteer(t *testing.T) {
+	gazetteer := "GEOID\tALAND\tAWATER\tALAND_SQMI\tAWATER_SQMI\tINTPTLAT\tINTPTLONG                  \n" +
+		"00601\t166847909\t799292\t64.420\t0.309\t18.180555\t-66.749961                  \n" +
+		"78704\t22127830\t204215\t8.544\t0.079\t30.242883\t-97.765840                  \n"
+
+	z, err := readZipcodes(strings.NewReader(gazetteer))
+	assert.NoError(t, err)
+	assert.Equal(t, Zipcodes{601: {Lat: 18.180555, Lon: -66.749961}, 78704: {Lat: 30.242883, Lon: -97.76584}}, z)
+
+	_, err = readZipcodes(strings.NewReader("zip,lat,lon\n78701,30.2,-97.7\n"))
+	assert.EqualError(t, err, "zipcode dataset has no latitude column")
+}
+
+func TestHaversine(t *testing.T) {
+	austin := Centroid{Lat: 30.267153, Lon: -97.743061}
+	dallas := Centroid{Lat: 32.776664, Lon: -96.796988}
+
+	assert.InDelta(t, 182.0, haversine(austin, dallas), 1.0)
+	assert.Equal(t, 0.0, haversine(austin, austin))
+
+	_, ok := nearestStore(austin, []Store{{No: 1}})
+	assert.False(t, ok)
+
+	_, err := readZipcodes(strings.NewReader("zip,latitude,longitude\n78701,north,-97.7\n"))
+	assert.Error(t, err)
+}
+
+func TestCatalogLocator(t *testing.T) {
+	catalog, err := NewCatalogLocator("data/stores.csv")
+	assert.NoError(t, err)
+
+	stores, err := catalog.Locate(78735)
+	assert.NoError(t, err)
+	if assert.Len(t, stores, 1) {
+		assert.Equal(t, 2133, stores[0].No)
+	}
+
+	// No store in 78701 itself, so every store in the 787 sectional center is a candidate.
+	stores, err = catalog.Locate(78701)
+	assert.NoError(t, err)
+	assert.Len(t, stores, 4)
+
+	stores, err = catalog.Locate(10001)
+	assert.NoError(t, err)
+	assert.Empty(t, stores)
+
+	_, err = readCatalog(strings.NewReader("no,name\n1,Broken\n"))
+	assert.Error(t, err)
+}
+
+func TestOrderIDDoesNotExist(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+
+	setAuthentication()
+	req, _ := http.NewRequest("GET", "/orders/15", nil)
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+}
+
+func TestGetOrder(t *testing.T) {
 	clearUsersTable()
 	clearOrdersTable()
 	clearOrderItemsTable()
@@ -456,11 +777,6 @@ func TestUpdateOrder(t *testing.T) {
 		log.Error(err)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
-	if err != nil {
-		log.Error(err)
-	}
-
 	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
 	if err != nil {
 		log.Error(err)
@@ -471,9 +787,7 @@ func TestUpdateOrder(t *testing.T) {
 		log.Error(err)
 	}
 
-	jsonStr := []byte(`{"user":"Test User", "user_id": 1, "items": [{"id": 1, "name": "apples"}, {"id": 3, "name": "avacado"}]}`)
-
-	req, _ := http.NewRequest("PUT", "/orders/1", bytes.NewBuffer(jsonStr))
+	req, _ := http.NewRequest("GET", "/orders/1", nil)
 
 	req.SetBasicAuth("Test User", "correct-password")
 
@@ -482,35 +796,45 @@ func TestUpdateOrder(t *testing.T) {
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apples"},{"id":3,"name":"avacado"}]}`, actual)
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1},{"id":2,"name":"oranges","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, actual)
 
 	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func TestUpdateOtherUsersOrder(t *testing.T) {
+func TestGetOrderOfOtherUser(t *testing.T) {
 	clearUsersTable()
 	clearOrdersTable()
 	clearOrderItemsTable()
 	clearItemsTable()
 
-	setAuthentication()
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("correct-password"), 8)
+	if err != nil {
+		log.Error(err)
+	}
 
-	_, err := a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('1', '1')")
+	statement := fmt.Sprintf(`INSERT INTO users(name,password) VALUES('%s', '%s')`, "First User", hashedPassword)
+	_, err = a.DB.Exec(statement)
 	if err != nil {
 		log.Error(err)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('2', '2')")
+	statement = fmt.Sprintf(`INSERT INTO users(name,password) VALUES('%s', '%s')`, "Attacker User", hashedPassword)
+	_, err = a.DB.Exec(statement)
 	if err != nil {
 		log.Error(err)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
+	_, err = a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
 	if err != nil {
 		log.Error(err)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
 	if err != nil {
 		log.Error(err)
 	}
@@ -524,64 +848,59 @@ func TestUpdateOtherUsersOrder(t *testing.T) {
 	if err != nil {
 		log.Error(err)
 	}
+	// The user_id query parameter is ignored, ownership comes from the credentials.
+	req, _ := http.NewRequest("GET", "/orders/1?user_id=1", nil)
 
-	jsonStr := []byte(`{"user":"First User", "user_id": 1, "items": [{"id": 1, "name": "apples"}, {"id": 3, "name": "avacado"}]}`)
-
-	req, _ := http.NewRequest("PUT", "/orders/1", bytes.NewBuffer(jsonStr))
-
-	req.SetBasicAuth("Test User", "correct-password")
+	req.SetBasicAuth("Attacker User", "correct-password")
 
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
-	actual := string(response.Body.Bytes())
-
-	assert.JSONEq(t, `{"error":"Forbidden."}`, actual)
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
 
-	assert.Equal(t, response.Code, http.StatusForbidden)
+	assert.Equal(t, response.Code, http.StatusNotFound)
 }
 
-func TestDeleteOrder(t *testing.T) {
+func TestCreateOrder(t *testing.T) {
+
 	clearUsersTable()
 	clearOrdersTable()
 	clearOrderItemsTable()
 	clearItemsTable()
 
 	setAuthentication()
+	insertItems("Apples", "Oranges")
 
-	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
-	if err != nil {
-		log.Error(err)
-	}
+	jsonStr := []byte(`{"user":"Test User", "user_id": 1, "items": [{"id": 1, "name": "Apples"}, {"id": 2, "name": "Oranges"}]}`)
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
-	if err != nil {
-		log.Error(err)
-	}
+	req, _ := http.NewRequest("POST", "/orders", bytes.NewBuffer(jsonStr))
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
-	if err != nil {
-		log.Error(err)
-	}
+	req.SetBasicAuth("Test User", "correct-password")
 
-	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
-	if err != nil {
-		log.Error(err)
-	}
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
-	if err != nil {
-		log.Error(err)
-	}
+	actual := string(response.Body.Bytes())
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 2)")
-	if err != nil {
-		log.Error(err)
-	}
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"Apples","quantity":1},{"id":2,"name":"Oranges","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, actual)
 
-	jsonStr := []byte(`{"user":"Test User", "user_id": 1}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+}
 
-	req, _ := http.NewRequest("DELETE", "/orders/1", bytes.NewBuffer(jsonStr))
+func TestCreateOrderForOtherUser(t *testing.T) {
+
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertUser("Other User")
+	insertItems("Apples")
+
+	jsonStr := []byte(`{"user":"Other User", "user_id": 2, "items": [{"id": 1, "name": "Apples"}]}`)
+
+	req, _ := http.NewRequest("POST", "/orders", bytes.NewBuffer(jsonStr))
 
 	req.SetBasicAuth("Test User", "correct-password")
 
@@ -590,12 +909,12 @@ func TestDeleteOrder(t *testing.T) {
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":null}`, actual)
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"Apples","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, actual)
 
 	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func TestDeleteOtherUsersOrder(t *testing.T) {
+func TestGetOrders(t *testing.T) {
 	clearUsersTable()
 	clearOrdersTable()
 	clearOrderItemsTable()
@@ -603,12 +922,12 @@ func TestDeleteOtherUsersOrder(t *testing.T) {
 
 	setAuthentication()
 
-	_, err := a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('1', '1')")
+	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
 	if err != nil {
 		log.Error(err)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('2', '2')")
+	_, err = a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
 	if err != nil {
 		log.Error(err)
 	}
@@ -633,14 +952,21 @@ func TestDeleteOtherUsersOrder(t *testing.T) {
 		log.Error(err)
 	}
 
-	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 3)")
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 2)")
 	if err != nil {
 		log.Error(err)
 	}
 
-	jsonStr := []byte(`{"user":"First User", "user_id": 1}`)
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 1)")
+	if err != nil {
+		log.Error(err)
+	}
 
-	req, _ := http.NewRequest("DELETE", "/orders/1", bytes.NewBuffer(jsonStr))
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 3)")
+	if err != nil {
+		log.Error(err)
+	}
+	req, _ := http.NewRequest("GET", "/orders?count=10&start=0", nil)
 
 	req.SetBasicAuth("Test User", "correct-password")
 
@@ -649,69 +975,1820 @@ func TestDeleteOtherUsersOrder(t *testing.T) {
 
 	actual := string(response.Body.Bytes())
 
-	assert.JSONEq(t, `{"error":"Forbidden."}`, actual)
+	assert.JSONEq(t, `{"orders":[{"id":2,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1},{"id":3,"name":"avacado","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"},{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1},{"id":2,"name":"oranges","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}]}`, actual)
 
-	assert.Equal(t, response.Code, http.StatusForbidden)
+	assert.Equal(t, response.Code, http.StatusOK)
 }
 
-func clearUsersTable() {
-	_, err := a.DB.Exec("DELETE FROM users")
-	if err != nil {
-		log.Error(err)
-	}
+func TestListOrders(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
 
-	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='users';")
-	if err != nil {
-		log.Error(err)
-	}
-}
+	setAuthentication()
+	insertItems("apple", "oranges")
 
-func clearOrdersTable() {
-	_, err := a.DB.Exec("DELETE FROM orders")
-	if err != nil {
-		log.Error(err)
-	}
+	send := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.SetBasicAuth("Test User", "correct-password")
 
-	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='orders';")
-	if err != nil {
-		log.Error(err)
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
 	}
-}
 
-func clearOrderItemsTable() {
-	_, err := a.DB.Exec("DELETE FROM order_items")
-	if err != nil {
-		log.Error(err)
-	}
+	list := func(url string) ([]int, OrderPage) {
+		response := send(url)
+		assert.Equal(t, http.StatusOK, response.Code)
 
-	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='order_items';")
-	if err != nil {
-		log.Error(err)
-	}
-}
+		var page OrderPage
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &page))
 
-func clearItemsTable() {
-	_, err := a.DB.Exec("DELETE FROM items")
-	if err != nil {
-		log.Error(err)
+		var ids []int
+		for _, o := range page.Orders {
+			ids = append(ids, o.ID)
+		}
+		return ids, page
 	}
 
-	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='items';")
-	if err != nil {
-		log.Error(err)
+	for i, created := range []string{"2024-01-10", "2024-02-10", "2024-03-10"} {
+		_, err := a.DB.Exec("INSERT INTO orders(user_id, created_at) VALUES(1, $1)", date(created).Unix())
+		assert.NoError(t, err)
+		_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES($1, $2)", i+1, i%2+1)
+		assert.NoError(t, err)
 	}
-}
+	_, err := a.DB.Exec("UPDATE orders SET status='placed' WHERE id=2")
+	assert.NoError(t, err)
 
-func setAuthentication() {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("correct-password"), 8)
-	if err != nil {
-		log.Error(err)
-	}
+	response := send("/orders?limit=2")
+	assert.Equal(t, http.StatusOK, response.Code)
+	link := response.Header().Get("Link")
+	assert.Contains(t, link, `rel="next"`)
 
-	statement := fmt.Sprintf(`INSERT INTO users(name,password) VALUES('%s', '%s')`, "Test User", hashedPassword)
-	_, err = a.DB.Exec(statement)
+	ids, page := list("/orders?limit=2")
+	assert.Equal(t, []int{3, 2}, ids)
+	assert.NotEmpty(t, page.NextCursor)
+	assert.Equal(t, "</orders?cursor="+page.NextCursor+"&limit=2>; rel=\"next\"", link)
+
+	// Following the cursor is not thrown off by orders created meanwhile.
+	_, err = a.DB.Exec("INSERT INTO orders(user_id, created_at) VALUES(1, $1)", date("2024-04-10").Unix())
+	assert.NoError(t, err)
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(4, 1)")
+	assert.NoError(t, err)
+
+	response = send("/orders?cursor=" + page.NextCursor + "&limit=2")
+	assert.Empty(t, response.Header().Get("Link"))
+
+	ids, page = list("/orders?cursor=" + page.NextCursor + "&limit=2")
+	assert.Equal(t, []int{1}, ids)
+	assert.Empty(t, page.NextCursor)
+
+	ids, page = list("/orders?sort=created_at&limit=1")
+	assert.Equal(t, []int{1}, ids)
+
+	ids, _ = list("/orders?sort=created_at&limit=3&cursor=" + page.NextCursor)
+	assert.Equal(t, []int{2, 3, 4}, ids)
+
+	ids, _ = list("/orders?status=placed,cancelled")
+	assert.Equal(t, []int{2}, ids)
+
+	ids, _ = list("/orders?from=2024-02-01&to=2024-03-10T00:00:00Z")
+	assert.Equal(t, []int{2}, ids)
+
+	ids, _ = list("/orders?item=2")
+	assert.Equal(t, []int{2}, ids)
+
+	// Older clients paging with count and start still work.
+	ids, _ = list("/orders?count=2&start=1")
+	assert.Equal(t, []int{3, 2}, ids)
+
+	// Out of range values of the aliases are corrected, not rejected.
+	for _, url := range []string{"/orders?count=0", "/orders?count=-5", "/orders?count=500", "/orders?count=all&start=-1"} {
+		ids, _ = list(url)
+		assert.Equal(t, []int{4, 3, 2, 1}, ids, url)
+	}
+
+	response = send("/orders?cursor=" + page.NextCursor)
+	assertProblem(t, response, codeValidation, "Cursor is for a different sort.")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	for _, url := range []string{"/orders?limit=101", "/orders?limit=0", "/orders?sort=name", "/orders?status=lost", "/orders?from=yesterday", "/orders?item=apple", "/orders?cursor=%21"} {
+		assert.Equal(t, http.StatusBadRequest, send(url).Code, url)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("apple")
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("GET", "/orders/1", "")
+	assert.JSONEq(t, `{"type":"/problems/order-not-found","title":"Order not found","status":404,"detail":"Order not found."}`, response.Body.String())
+	assert.Equal(t, "application/problem+json", response.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = send("GET", "/orders?limit=101", "")
+	assert.JSONEq(t, `{"type":"/problems/validation-failed","title":"Validation failed","status":400,"detail":"Limit must be between 1 and 100.",
+		"errors":[{"field":"limit","message":"Limit must be between 1 and 100."}]}`, response.Body.String())
+
+	response = send("POST", "/orders", `{"items": [{"id": 1}, {"id": 8}, {"id": 9}]}`)
+	assert.JSONEq(t, `{"type":"/problems/invalid-items","title":"Invalid items","status":400,"detail":"Items are unknown or archived: [8 9].",
+		"errors":[{"field":"items","message":"item 8 is unknown or archived"},{"field":"items","message":"item 9 is unknown or archived"}]}`, response.Body.String())
+
+	// Bodies that are not JSON are reported as such, not as a bad id.
+	response = send("POST", "/users", `{"name":`)
+	assertProblem(t, response, codeInvalidRequest, "User is invalid.")
+
+	response = send("GET", "/orders/x", "")
+	assertProblem(t, response, codeNotFound, "Not found.")
+}
+
+func TestPayloadValidation(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	setAdmin("Test User")
+	insertItems("apple")
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	// Every violation is reported at once, unknown fields included.
+	response := send("POST", "/users", `{"name": " ", "password": "password", "zipcode": 123, "emial": "a@b.c"}`)
+	assert.JSONEq(t, `{"type":"/problems/validation-failed","title":"Validation failed","status":400,"detail":"User is invalid.","errors":[
+		{"field":"emial","message":"is not a known field"},
+		{"field":"name","message":"is required"},
+		{"field":"email","message":"is required"},
+		{"field":"password","message":"must mix letters with digits or symbols"},
+		{"field":"zipcode","message":"must be a 5 digit US ZIP code"}]}`, response.Body.String())
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = send("POST", "/users", `{"name": "New User", "email": "New User <new@example.com>", "password": "sh0rt", "zipcode": "78704"}`)
+	assert.JSONEq(t, `{"type":"/problems/validation-failed","title":"Validation failed","status":400,"detail":"User is invalid.","errors":[
+		{"field":"zipcode","message":"must be a number"},
+		{"field":"email","message":"must be an email address"},
+		{"field":"password","message":"must be at least 8 characters"},
+		{"field":"zipcode","message":"must be a 5 digit US ZIP code"}]}`, response.Body.String())
+
+	response = send("POST", "/orders", `{"items": [{"id": 1, "qty": 2}, {"quantity": 1001}]}`)
+	assert.JSONEq(t, `{"type":"/problems/validation-failed","title":"Validation failed","status":400,"detail":"Order is invalid.","errors":[
+		{"field":"items[0].qty","message":"is not a known field"},
+		{"field":"items[1].id","message":"must be at least 1"},
+		{"field":"items[1].quantity","message":"must be at most 1000"}]}`, response.Body.String())
+	assert.Equal(t, 0, countRows("orders"))
+
+	lines := make([]string, maxOrderLines+1)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`{"id": %d}`, i+1)
+	}
+	response = send("POST", "/orders", `{"items": [`+strings.Join(lines, ", ")+`]}`)
+	assert.Contains(t, response.Body.String(), `{"field":"items","message":"must be at most 100"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	// What GET returns can be sent back as it is.
+	response = send("POST", "/orders", `{"items": [{"id": 1, "name": "apple"}]}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = send("PUT", "/orders/1", send("GET", "/orders/1", "").Body.String())
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = send("POST", "/items", `{"name": "Kiwi", "sku": "`+strings.Repeat("K", 65)+`", "unit_price": -5, "colour": "green"}`)
+	assert.JSONEq(t, `{"type":"/problems/validation-failed","title":"Validation failed","status":400,"detail":"Item is invalid.","errors":[
+		{"field":"colour","message":"is not a known field"},
+		{"field":"sku","message":"must be at most 64 characters"},
+		{"field":"unit_price","message":"must be at least 0"}]}`, response.Body.String())
+
+	response = send("POST", "/items", `["Kiwi"]`)
+	assertProblem(t, response, codeInvalidRequest, "Item is invalid.")
+
+	response = send("POST", "/items", `{"name": "Kiwi"`)
+	assertProblem(t, response, codeInvalidRequest, "Item is invalid.")
+}
+
+func TestEmptyOrders(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("apple")
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("GET", "/orders", "")
+	assert.JSONEq(t, `{"orders":[]}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("POST", "/orders", `{"items": []}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders/1", "")
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders", "")
+	assert.JSONEq(t, `{"orders":[{"id":1,"user":"Test User","user_id":1,"items":[],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}]}`, response.Body.String())
+
+	response = send("POST", "/orders/1/transitions", `{"status": "placed"}`)
+	assertProblem(t, response, codeEmptyOrder, "Order has no items.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("POST", "/orders/1/transitions", `{"status": "placed"}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("PUT", "/orders/1", `{"items": []}`)
+	assertProblem(t, response, codeEmptyOrder, "Order has no items.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("GET", "/orders?status=cancelled", "")
+	assert.JSONEq(t, `{"orders":[]}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+}
+
+func date(value string) time.Time {
+	t, _ := time.Parse("2006-01-02", value)
+	return t
+}
+
+func TestUpdateOrder(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+
+	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 2)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	jsonStr := []byte(`{"user":"Test User", "user_id": 1, "items": [{"id": 1, "name": "apples"}, {"id": 3, "name": "avacado"}]}`)
+
+	req, _ := http.NewRequest("PUT", "/orders/1", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+	req.Header.Set("If-Match", `"1"`)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	actual := string(response.Body.Bytes())
+
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apples","quantity":1},{"id":3,"name":"avacado","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, actual)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+}
+
+func TestOrderETags(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("apple", "oranges")
+
+	send := func(method, url, etag, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("POST", "/orders", "", `{"items": [{"id": 1, "name": "apple"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders/1", "", "")
+	assert.Equal(t, `"1"`, response.Header().Get("ETag"))
+
+	response = send("PUT", "/orders/1", "", `{"items": [{"id": 2, "name": "oranges"}]}`)
+	assertProblem(t, response, codePreconditionRequired, "If-Match header is required.")
+	assert.Equal(t, response.Code, http.StatusPreconditionRequired)
+
+	response = send("PUT", "/orders/1", `"1"`, `{"items": [{"id": 2, "name": "oranges"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Equal(t, `"2"`, response.Header().Get("ETag"))
+
+	// The other device still holds the first version.
+	response = send("PUT", "/orders/1", `"1"`, `{"items": [{"id": 1, "name": "apple"}]}`)
+	assertProblem(t, response, codeStaleOrder, "Order has been changed since it was read.")
+	assert.Equal(t, response.Code, http.StatusPreconditionFailed)
+	assert.Equal(t, []int{2}, orderItemIDs(1))
+
+	response = send("DELETE", "/orders/1", `W/"2"`, "")
+	assert.Equal(t, response.Code, http.StatusPreconditionFailed)
+
+	response = send("DELETE", "/orders/1", "", "")
+	assert.Equal(t, response.Code, http.StatusPreconditionRequired)
+
+	response = send("POST", "/orders/1/transitions", "", `{"status":"placed"}`)
+	assert.Equal(t, `"3"`, response.Header().Get("ETag"))
+
+	response = send("DELETE", "/orders/1", `"2"`, "")
+	assert.Equal(t, response.Code, http.StatusPreconditionFailed)
+
+	response = send("DELETE", "/orders/1", `"3"`, "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders/1", "", "")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+}
+
+func TestPatchOrder(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("apple", "oranges", "avacado")
+
+	send := func(method, contentType, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/orders/1", bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+		req.Header.Set("If-Match", "*")
+		req.Header.Set("Content-Type", contentType)
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	req, _ := http.NewRequest("POST", "/orders", bytes.NewBufferString(`{"items": [{"id": 1, "name": "apple"}, {"id": 2, "name": "oranges"}]}`))
+	req.SetBasicAuth("Test User", "correct-password")
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("PATCH", "application/json-patch+json", `[
+		{"op": "test", "path": "/items/1/id", "value": 2},
+		{"op": "replace", "path": "/items/1/quantity", "value": 4},
+		{"op": "remove", "path": "/items/0"},
+		{"op": "add", "path": "/items/-", "value": {"id": 3, "quantity": 2}}
+	]`)
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":2,"name":"oranges","quantity":4},{"id":3,"name":"avacado","quantity":2}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Equal(t, `"2"`, response.Header().Get("ETag"))
+
+	response = send("PATCH", "application/merge-patch+json", `{"items": {"1": {"quantity": 3}, "2": null, "3": {"quantity": 1}}}`)
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","quantity":3},{"id":3,"name":"avacado","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	// A failing test operation applies none of the patch.
+	response = send("PATCH", "application/json-patch+json", `[
+		{"op": "remove", "path": "/items/0"},
+		{"op": "test", "path": "/items/0/quantity", "value": 5}
+	]`)
+	assertProblem(t, response, codePatchTestFailed, "Patch test failed.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+	assert.Equal(t, []int{1, 3}, orderItemIDs(1))
+
+	// A quantity a patch sets is not read as 1 when it is 0.
+	for _, patch := range []struct{ contentType, body, field string }{
+		{"application/json-patch+json", `[{"op": "replace", "path": "/items/1/quantity", "value": 0}]`, "items[1].quantity"},
+		{"application/json-patch+json", `[{"op": "add", "path": "/items/-", "value": {"id": 2, "quantity": 0}}]`, "items[2].quantity"},
+		{"application/merge-patch+json", `{"items": {"3": {"quantity": 0}}}`, "items[1].quantity"},
+		{"application/merge-patch+json", `{"items": {"2": {"quantity": -1}}}`, "items[2].quantity"},
+		{"application/merge-patch+json", `{"items": [{"id": 1}, {"id": 3, "quantity": 0}]}`, "items[1].quantity"},
+	} {
+		response = send("PATCH", patch.contentType, patch.body)
+		assertProblem(t, response, codeValidation, "Order is invalid.")
+		assert.Contains(t, response.Body.String(), `{"field":"`+patch.field+`","message":"must be at least 1"}`, patch.body)
+	}
+	assert.Equal(t, []int{1, 3}, orderItemIDs(1))
+
+	response = send("PATCH", "application/json-patch+json", `[{"op": "replace", "path": "/status", "value": "completed"}]`)
+	assertProblem(t, response, codeInvalidPatch, "Patch is invalid: path \"/status\" is not an order line.")
+	assert.Equal(t, response.Code, http.StatusUnprocessableEntity)
+
+	// Drafts can be emptied.
+	response = send("PATCH", "application/merge-patch+json", `{"items": {"1": null, "3": null}}`)
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Empty(t, orderItemIDs(1))
+
+	response = send("PATCH", "application/merge-patch+json", `{"items": {"7": {}}}`)
+	assertProblem(t, response, codeInvalidItems, "Items are unknown or archived: [7].")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	response = send("PATCH", "application/json", `{"items": []}`)
+	assert.Equal(t, response.Code, http.StatusUnsupportedMediaType)
+	assert.Equal(t, "application/json-patch+json, application/merge-patch+json", response.Header().Get("Accept-Patch"))
+
+	response = send("PATCH", "application/json-patch+json", `{"op": "remove"}`)
+	assertProblem(t, response, codeInvalidRequest, "Patch is invalid.")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+}
+
+func TestOrderHistory(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertUser("Other User")
+	insertUser("Support")
+	setAdmin("Support")
+	insertItems("apple", "oranges", "avacado")
+
+	send := func(user, method, url, etag, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "correct-password")
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("Test User", "POST", "/orders", "", `{"items": [{"id": 1, "name": "apple"}, {"id": 2, "name": "oranges", "quantity": 2}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "PUT", "/orders/1", `"1"`, `{"items": [{"id": 1, "name": "apple", "quantity": 3}, {"id": 3, "name": "avacado"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "DELETE", "/orders/1", `"2"`, "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	expected := []Revision{
+		{Version: 1, Action: revisionCreated, UserID: 1, User: "Test User", Changes: []LineChange{{ItemID: 1, From: 0, To: 1}, {ItemID: 2, From: 0, To: 2}}},
+		{Version: 2, Action: revisionUpdated, UserID: 1, User: "Test User", Changes: []LineChange{{ItemID: 1, From: 1, To: 3}, {ItemID: 2, From: 2, To: 0}, {ItemID: 3, From: 0, To: 1}}},
+		{Version: 3, Action: revisionDeleted, UserID: 1, User: "Test User", Changes: []LineChange{{ItemID: 1, From: 3, To: 0}, {ItemID: 3, From: 1, To: 0}}},
+	}
+
+	// The history outlives the order, for its owner and for support.
+	for _, user := range []string{"Test User", "Support"} {
+		response = send(user, "GET", "/orders/1/history", "", "")
+		assert.Equal(t, response.Code, http.StatusOK)
+
+		var history []Revision
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &history))
+		for i := range history {
+			assert.WithinDuration(t, time.Now(), history[i].At, time.Minute)
+			history[i].At = time.Time{}
+		}
+		assert.Equal(t, expected, history)
+	}
+
+	response = send("Other User", "GET", "/orders/1/history", "", "")
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	// Orders from before revisions were recorded have an empty history.
+	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES(1)")
+	assert.NoError(t, err)
+
+	response = send("Test User", "GET", "/orders/2/history", "", "")
+	assert.JSONEq(t, `[]`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	// Without a 'created' revision, the order itself tells whose it is.
+	response = send("Test User", "PUT", "/orders/2", "*", `{"items": [{"id": 1}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "GET", "/orders/2/history", "", "")
+	var history []Revision
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &history))
+	assert.Len(t, history, 1)
+	assert.Equal(t, revisionUpdated, history[0].Action)
+
+	response = send("Other User", "GET", "/orders/2/history", "", "")
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+}
+
+func TestRestoreOrder(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertUser("Other User")
+	insertItems("apple")
+
+	send := func(user, method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("Test User", "POST", "/orders", `{"items": [{"id": 1, "name": "apple"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "DELETE", "/orders/1", "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "GET", "/orders/1", "")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = send("Test User", "PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple"}]}`)
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = send("Other User", "POST", "/orders/1/restore", "")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = send("Test User", "POST", "/orders/1/restore", "")
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Equal(t, `"3"`, response.Header().Get("ETag"))
+
+	response = send("Test User", "POST", "/orders/1/restore", "")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	// Past the restore window the order can no longer come back, and once
+	// its retention expired it is purged.
+	response = send("Test User", "DELETE", "/orders/1", "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	_, err := a.DB.Exec("UPDATE orders SET deleted_at=$1", time.Now().Add(-a.RestoreWindow-time.Minute).Unix())
+	assert.NoError(t, err)
+
+	response = send("Test User", "POST", "/orders/1/restore", "")
+	assertProblem(t, response, codeRestoreExpired, "Order can no longer be restored.")
+	assert.Equal(t, response.Code, http.StatusGone)
+
+	a.purgeExpiredOrders()
+	assert.Equal(t, 1, countRows("orders"))
+
+	_, err = a.DB.Exec("UPDATE orders SET deleted_at=$1", time.Now().Add(-a.OrderRetention-time.Minute).Unix())
+	assert.NoError(t, err)
+
+	a.purgeExpiredOrders()
+	assert.Equal(t, 0, countRows("orders"))
+	assert.Nil(t, orderItemIDs(1))
+
+	response = send("Test User", "GET", "/orders/1/history", "")
+	assert.Equal(t, response.Code, http.StatusOK)
+}
+
+func TestUpdateOtherUsersOrder(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertUser("Other User")
+
+	_, err := a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('1', '1')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('2', '2')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 1)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 2)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	jsonStr := []byte(`{"user":"Other User", "user_id": 2, "items": [{"id": 1, "name": "apples"}, {"id": 3, "name": "avacado"}]}`)
+
+	req, _ := http.NewRequest("PUT", "/orders/2", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+	req.Header.Set("If-Match", `"1"`)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+
+	assert.Equal(t, response.Code, http.StatusNotFound)
+}
+
+func TestDeleteOrder(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+
+	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(2, 2)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	jsonStr := []byte(`{"user":"Test User", "user_id": 1}`)
+
+	req, _ := http.NewRequest("DELETE", "/orders/1", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+	req.Header.Set("If-Match", `"1"`)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	actual := string(response.Body.Bytes())
+
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":null,"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft"}`, actual)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	// The order is only marked deleted and keeps its items, so it can be
+	// restored.
+	assert.Equal(t, 1, countDeletedOrders())
+	assert.Equal(t, []int{1}, orderItemIDs(1))
+	assert.Equal(t, []int{2}, orderItemIDs(2))
+}
+
+func TestDeleteOtherUsersOrder(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertUser("Other User")
+
+	_, err := a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('1', '1')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO orders(id, user_id) VALUES('2', '2')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('apple')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('oranges')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO items(name) VALUES('avacado')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 3)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	jsonStr := []byte(`{"user":"Other User", "user_id": 2}`)
+
+	req, _ := http.NewRequest("DELETE", "/orders/2", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+	req.Header.Set("If-Match", `"1"`)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	var count int
+	err = a.DB.QueryRow("SELECT COUNT(*) FROM orders WHERE id=2").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestItemsForbidden(t *testing.T) {
+	clearUsersTable()
+	clearItemsTable()
+
+	setAuthentication()
+
+	req, _ := http.NewRequest("POST", "/items", bytes.NewBufferString(`{"name": "Apples"}`))
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeForbidden, "Forbidden.")
+
+	assert.Equal(t, response.Code, http.StatusForbidden)
+	assert.Equal(t, 0, countRows("items"))
+}
+
+func TestItemCatalog(t *testing.T) {
+	clearUsersTable()
+	clearItemsTable()
+
+	setAuthentication()
+	setAdmin("Test User")
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("POST", "/items", `{"name": "Apples", "sku": "FRT-001", "description": "Gala", "unit_price": 129, "category": "fruit"}`)
+	assert.JSONEq(t, `{"id":1,"name":"Apples","sku":"FRT-001","description":"Gala","unit_price":129,"category":"fruit"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusCreated)
+
+	response = send("POST", "/items", `{"name": "Green Apples", "sku": "FRT-001"}`)
+	assertProblem(t, response, codeDuplicateSKU, "SKU already exists.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("POST", "/items", `{"name": "", "unit_price": -1}`)
+	assertProblem(t, response, codeValidation, "Item is invalid.")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	response = send("POST", "/items", `{"name": "Oranges"}`)
+	assert.Equal(t, response.Code, http.StatusCreated)
+
+	response = send("PUT", "/items/2", `{"name": "Oranges", "sku": "FRT-002", "unit_price": 89, "category": "fruit"}`)
+	assert.JSONEq(t, `{"id":2,"name":"Oranges","sku":"FRT-002","unit_price":89,"category":"fruit"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("PUT", "/items/3", `{"name": "Avacado"}`)
+	assertProblem(t, response, codeNotFound, "Item not found.")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = send("POST", "/items/2/archive", "")
+	assert.JSONEq(t, `{"id":2,"name":"Oranges","sku":"FRT-002","unit_price":89,"category":"fruit","archived":true}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/items/2", "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/items", "")
+	assert.JSONEq(t, `[{"id":1,"name":"Apples","sku":"FRT-001","description":"Gala","unit_price":129,"category":"fruit"}]`, response.Body.String())
+
+	response = send("GET", "/items?archived=true", "")
+	var items Items
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &items))
+	assert.Equal(t, 2, len(items))
+}
+
+func TestCreateOrderInvalidItems(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("Apples", "Oranges")
+
+	_, err := a.DB.Exec("UPDATE items SET archived=1 WHERE id=2")
+	assert.NoError(t, err)
+
+	jsonStr := []byte(`{"items": [{"id": 1, "name": "Apples"}, {"id": 2, "name": "Oranges"}, {"id": 7, "name": "Kiwis"}]}`)
+
+	req, _ := http.NewRequest("POST", "/orders", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeInvalidItems, "Items are unknown or archived: [2 7].")
+
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+	assert.Equal(t, 0, countRows("orders"))
+}
+
+func TestOrderQuantitiesAndTotals(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("apple", "oranges")
+
+	_, err := a.DB.Exec("UPDATE items SET unit_price=id*100+25")
+	assert.NoError(t, err)
+
+	a.TaxRate = 825
+	defer func() { a.TaxRate = 0 }()
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("Test User", "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("POST", "/orders", `{"items": [{"id": 1, "name": "apple", "quantity": 3}, {"id": 2, "name": "oranges", "unit_price": 1}]}`)
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","unit_price":125,"quantity":3,"line_total":375},{"id":2,"name":"oranges","unit_price":225,"quantity":1,"line_total":225}],"subtotal":600,"tax_rate":825,"tax":50,"total":650,"status":"draft"}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	_, err = a.DB.Exec("UPDATE items SET unit_price=999 WHERE id=1")
+	assert.NoError(t, err)
+
+	response = send("PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple", "quantity": 1}, {"id": 2, "name": "oranges", "quantity": 2}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders/1", "")
+	assert.JSONEq(t, `{"id":1,"user":"Test User","user_id":1,"items":[{"id":1,"name":"apple","unit_price":125,"quantity":1,"line_total":125},{"id":2,"name":"oranges","unit_price":225,"quantity":2,"line_total":450}],"subtotal":575,"tax_rate":825,"tax":47,"total":622,"status":"draft"}`, response.Body.String())
+
+	response = send("PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple", "quantity": -1}]}`)
+	assertProblem(t, response, codeValidation, "Order is invalid.")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+}
+
+func TestOrderTransitions(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertUser("Store Admin")
+	setAdmin("Store Admin")
+	insertItems("apple")
+
+	send := func(user, method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("Test User", "POST", "/orders", `{"items": [{"id": 1, "name": "apple"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "POST", "/orders/1/transitions", `{"status": "shipped"}`)
+	assertProblem(t, response, codeInvalidRequest, "Order status is invalid.")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	response = send("Test User", "POST", "/orders/1/transitions", `{"status": "picking"}`)
+	assertProblem(t, response, codeInvalidTransition, "Order can not move from draft to picking.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("Test User", "POST", "/orders/1/transitions", `{"status": "placed"}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	o := Order{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &o))
+	assert.Equal(t, statusPlaced, o.Status)
+	assert.Equal(t, []Transition{{From: statusDraft, To: statusPlaced, At: o.Transitions[0].At}}, o.Transitions)
+
+	// Only staff move an order into fulfilment, and can do so for any user.
+	response = send("Test User", "POST", "/orders/1/transitions", `{"status": "picking"}`)
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("Store Admin", "POST", "/orders/1/transitions", `{"status": "picking"}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Test User", "PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple", "quantity": 2}]}`)
+	assertProblem(t, response, codeOrderLocked, "Order can no longer be changed.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("Test User", "DELETE", "/orders/1", "")
+	assertProblem(t, response, codeOrderLocked, "Order can no longer be changed.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("Test User", "GET", "/orders/1", "")
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &o))
+	assert.Equal(t, statusPicking, o.Status)
+	assert.Equal(t, 2, len(o.Transitions))
+
+	response = send("Test User", "POST", "/orders/2/transitions", `{"status": "placed"}`)
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+}
+
+func TestOrderReservesStock(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+	clearInventoryTable()
+
+	jsonStr := []byte(`{"name":"Shopper", "email": "shopper@example.com", "password": "correct-password", "zipcode": 78704}`)
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
+	a.Router.ServeHTTP(httptest.NewRecorder(), req)
+	followVerification(&a, "shopper@example.com")
+
+	insertUser("Store Admin")
+	setAdmin("Store Admin")
+	insertItems("apple", "oranges")
+
+	send := func(user, method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "correct-password")
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	response := send("Store Admin", "PUT", "/stores/1253/inventory/1", `{"on_hand": 2}`)
+	assert.JSONEq(t, `{"store_no":1253,"item_id":1,"on_hand":2,"reserved":0,"available":2}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Store Admin", "PUT", "/stores/1253/inventory/2", `{"on_hand": 5}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Store Admin", "PUT", "/stores/9999/inventory/1", `{"on_hand": 5}`)
+	assertProblem(t, response, codeNotFound, "Store or item not found.")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = send("Shopper", "PUT", "/stores/1253/inventory/1", `{"on_hand": 50}`)
+	assert.Equal(t, response.Code, http.StatusForbidden)
+
+	response = send("Shopper", "POST", "/orders", `{"items": [{"id": 1, "name": "apple", "quantity": 3}, {"id": 2, "name": "oranges"}]}`)
+	assert.JSONEq(t, `{"type":"/problems/insufficient-stock","title":"Insufficient stock","status":409,"detail":"Insufficient stock.","items":[{"id":1,"requested":3,"available":2}]}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusConflict)
+	assert.Equal(t, 0, countRows("orders"))
+
+	response = send("Shopper", "POST", "/orders", `{"items": [{"id": 1, "name": "apple", "quantity": 2}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Shopper", "PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple", "quantity": 1}, {"id": 2, "name": "oranges", "quantity": 6}]}`)
+	assert.JSONEq(t, `{"type":"/problems/insufficient-stock","title":"Insufficient stock","status":409,"detail":"Insufficient stock.","items":[{"id":2,"requested":6,"available":5}]}`, response.Body.String())
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("Store Admin", "GET", "/stores/1253/inventory", "")
+	assert.JSONEq(t, `[{"store_no":1253,"item_id":1,"on_hand":2,"reserved":2,"available":0},{"store_no":1253,"item_id":2,"on_hand":5,"reserved":0,"available":5}]`, response.Body.String())
+
+	response = send("Store Admin", "PUT", "/stores/1253/inventory/1", `{"on_hand": 1}`)
+	assertProblem(t, response, codeStockReserved, "Stock can not go below what is reserved.")
+	assert.Equal(t, response.Code, http.StatusConflict)
+
+	response = send("Shopper", "DELETE", "/orders/1", "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("Store Admin", "GET", "/stores/1253/inventory", "")
+	assert.JSONEq(t, `[{"store_no":1253,"item_id":1,"on_hand":2,"reserved":0,"available":2},{"store_no":1253,"item_id":2,"on_hand":5,"reserved":0,"available":5}]`, response.Body.String())
+}
+
+func TestCreateOrderIdempotencyKey(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+	clearIdempotencyKeysTable()
+
+	setAuthentication()
+	insertUser("Other User")
+	insertItems("apple", "oranges")
+
+	send := func(user, key, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/orders", bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "correct-password")
+		req.Header.Set("Idempotency-Key", key)
+
+		response := httptest.NewRecorder()
+		a.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	body := `{"items": [{"id": 1, "name": "apple"}]}`
+
+	first := send("Test User", "retry-1", body)
+	assert.Equal(t, first.Code, http.StatusOK)
+
+	retry := send("Test User", "retry-1", body)
+	assert.Equal(t, retry.Code, http.StatusOK)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, 1, countRows("orders"))
+
+	response := send("Test User", "retry-1", `{"items": [{"id": 2, "name": "oranges"}]}`)
+	assertProblem(t, response, codeUnprocessable, "Idempotency-Key was already used for a different request.")
+	assert.Equal(t, response.Code, http.StatusUnprocessableEntity)
+
+	// Keys are scoped to the user.
+	response = send("Other User", "retry-1", body)
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Empty(t, response.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, countRows("orders"))
+
+	// Client errors are replayed too, server errors are not stored.
+	response = send("Test User", "retry-2", `{"items": [{"id": 7, "name": "kiwi"}]}`)
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	response = send("Test User", "retry-2", `{"items": [{"id": 7, "name": "kiwi"}]}`)
+	assert.Equal(t, "true", response.Header().Get("Idempotent-Replayed"))
+
+	restore := injectFailure("BEFORE INSERT ON orders")
+	response = send("Test User", "retry-3", body)
+	restore()
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+
+	response = send("Test User", "retry-3", body)
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Empty(t, response.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 3, countRows("orders"))
+}
+
+func TestIdempotencyKeyReleasedOnPanic(t *testing.T) {
+	clearUsersTable()
+	clearIdempotencyKeysTable()
+
+	setAuthentication()
+
+	panics := true
+	handler := a.authenticate(a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic("handler failed")
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"message": "done"})
+	}))
+
+	send := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/orders", bytes.NewBufferString(`{}`))
+		req.SetBasicAuth("Test User", "correct-password")
+		req.Header.Set("Idempotency-Key", "panic-1")
+
+		response := httptest.NewRecorder()
+		handler(response, req)
+		return response
+	}
+
+	assert.PanicsWithValue(t, "handler failed", func() { send() })
+
+	// The retry runs the handler again rather than waiting on the first try.
+	panics = false
+	response := send()
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Empty(t, response.Header().Get("Idempotent-Replayed"))
+}
+
+func TestCreateOrderRollsBack(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("Apples", "Oranges")
+
+	defer injectFailure("BEFORE INSERT ON order_items WHEN NEW.item_id=2")()
+
+	jsonStr := []byte(`{"items": [{"id": 1, "name": "Apples"}, {"id": 2, "name": "Oranges"}]}`)
+
+	req, _ := http.NewRequest("POST", "/orders", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeInternal, "Order could not be created.")
+
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+
+	assert.Equal(t, 0, countRows("orders"))
+	assert.Equal(t, 0, countRows("order_items"))
+}
+
+func TestCreateOrderDuplicateItemsRollsBack(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("Apples")
+
+	jsonStr := []byte(`{"items": [{"id": 1, "name": "Apples"}, {"id": 1, "name": "Apples"}]}`)
+
+	req, _ := http.NewRequest("POST", "/orders", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeValidation, "Order is invalid.")
+	assert.Contains(t, response.Body.String(), `{"field":"items[1].id","message":"is already on another line"}`)
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	assert.Equal(t, 0, countRows("orders"))
+	assert.Equal(t, 0, countRows("order_items"))
+}
+
+func TestUpdateOrderRollsBack(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+	insertItems("apples", "oranges", "avacado")
+
+	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 2)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	// The add of item 3 succeeds before the delete of item 2 fails.
+	defer injectFailure("BEFORE DELETE ON order_items WHEN OLD.item_id=2")()
+
+	jsonStr := []byte(`{"items": [{"id": 1, "name": "apples"}, {"id": 3, "name": "avacado"}]}`)
+
+	req, _ := http.NewRequest("PUT", "/orders/1", bytes.NewBuffer(jsonStr))
+
+	req.SetBasicAuth("Test User", "correct-password")
+	req.Header.Set("If-Match", `"1"`)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeInternal, "Order could not be updated.")
+
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+
+	assert.Equal(t, []int{1, 2}, orderItemIDs(1))
+}
+
+func TestDeleteOrderRollsBack(t *testing.T) {
+	clearUsersTable()
+	clearOrdersTable()
+	clearOrderItemsTable()
+	clearItemsTable()
+
+	setAuthentication()
+
+	_, err := a.DB.Exec("INSERT INTO orders(user_id) VALUES('1')")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("INSERT INTO order_items(order_id, item_id) VALUES(1, 1)")
+	if err != nil {
+		log.Error(err)
+	}
+
+	// The revision is recorded before the orders row fails to be marked
+	// deleted.
+	defer injectFailure("BEFORE UPDATE OF deleted_at ON orders")()
+
+	req, _ := http.NewRequest("DELETE", "/orders/1", nil)
+
+	req.SetBasicAuth("Test User", "correct-password")
+	req.Header.Set("If-Match", `"1"`)
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeInternal, "Order could not be deleted.")
+
+	assert.Equal(t, response.Code, http.StatusInternalServerError)
+
+	assert.Equal(t, 0, countDeletedOrders())
+	assert.Equal(t, 0, countRows("order_revisions"))
+}
+
+// injectFailure installs a trigger that aborts the matching write, and
+// returns a func that removes it again.
+func injectFailure(event string) func() {
+	statement := fmt.Sprintf("CREATE TRIGGER inject_failure %s BEGIN SELECT RAISE(ABORT, 'injected failure'); END;", event)
+	_, err := a.DB.Exec(statement)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return func() {
+		_, err := a.DB.Exec("DROP TRIGGER IF EXISTS inject_failure")
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// assertProblem checks that the response is a problem of the code, with the
+// status the code is sent with.
+func assertProblem(t *testing.T, response *httptest.ResponseRecorder, code errorCode, detail string) {
+	assert.Equal(t, problemContentType, response.Header().Get("Content-Type"))
+
+	var p problem
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &p))
+	assert.Equal(t, "/problems/"+string(code), p.Type)
+	assert.Equal(t, detail, p.Detail)
+	assert.Equal(t, response.Code, p.Status)
+	assert.Equal(t, errorKinds[code].status, p.Status)
+}
+
+// outbox keeps the mail the app sends during tests instead of delivering it.
+type outbox struct {
+	mu   sync.Mutex
+	mail []Mail
+}
+
+var mailed = &outbox{}
+
+func (o *outbox) Send(m Mail) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.mail = append(o.mail, m)
+	return nil
+}
+
+func (o *outbox) last(to string) (Mail, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := len(o.mail) - 1; i >= 0; i-- {
+		if o.mail[i].To == to {
+			return o.mail[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+func (o *outbox) count(to string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	count := 0
+	for _, m := range o.mail {
+		if m.To == to {
+			count++
+		}
+	}
+	return count
+}
+
+// link is the verification link of the last mail to the address.
+func (o *outbox) link(to string) string {
+	m, _ := o.last(to)
+	for _, line := range strings.Split(m.Body, "\r\n") {
+		if strings.HasPrefix(line, "http") {
+			return line
+		}
+	}
+	return ""
+}
+
+// followVerification verifies the address the way users do, with the link
+// mailed to it.
+func followVerification(app *App, address string) {
+	req, _ := http.NewRequest("GET", mailed.link(address), nil)
+	app.Router.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func countRows(table string) int {
+	var count int
+	err := a.DB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+	if err != nil {
+		log.Error(err)
+	}
+	return count
+}
+
+func countDeletedOrders() int {
+	var count int
+	err := a.DB.QueryRow("SELECT COUNT(*) FROM orders WHERE deleted_at IS NOT NULL").Scan(&count)
+	if err != nil {
+		log.Error(err)
+	}
+	return count
+}
+
+func orderItemIDs(orderID int) []int {
+	rows, err := a.DB.Query("SELECT item_id FROM order_items WHERE order_id=$1 ORDER BY item_id", orderID)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Error(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestMemoryRepositoryUsers(t *testing.T) {
+	m := newMemoryApp()
+
+	jsonStr := []byte(`{"name":"Memory User", "email": "memory@example.com", "password": "correct-password", "zipcode": 78704}`)
+
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
+
+	response := httptest.NewRecorder()
+	m.Router.ServeHTTP(response, req)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	req, _ = http.NewRequest("GET", "/users/1", nil)
+
+	req.SetBasicAuth("Memory User", "correct-password")
+
+	response = httptest.NewRecorder()
+	m.Router.ServeHTTP(response, req)
+
+	assertProblem(t, response, codeEmailUnverified, "Email address is not verified.")
+
+	followVerification(m, "memory@example.com")
+
+	req, _ = http.NewRequest("GET", "/users/1", nil)
+
+	req.SetBasicAuth("Memory User", "correct-password")
+
+	response = httptest.NewRecorder()
+	m.Router.ServeHTTP(response, req)
+
+	actual := string(response.Body.Bytes())
+
+	expected := `{"id":1,"name":"Memory User","email":"memory@example.com","role":"user","closest_store":{"city":"Austin","coordinates":[-97.753926,30.221033],"country":"US","distance":1.67,"name":"Austin Supercenter","no":1253,"phoneNumber":"512-443-6601","stateProvCode":"TX","streetAddress":"710 E Ben White Blvd","sundayOpen":true,"timezone":"CST","zip":"78704"}}`
+
+	assert.JSONEq(t, expected, actual)
+
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	req, _ = http.NewRequest("GET", "/users/1", nil)
+
+	req.SetBasicAuth("Memory User", "wrong-password")
+
+	response = httptest.NewRecorder()
+	m.Router.ServeHTTP(response, req)
+
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+}
+
+func TestMemoryRepositoryOrders(t *testing.T) {
+	m := newMemoryApp()
+
+	jsonStr := []byte(`{"name":"Memory User", "email": "memory@example.com", "password": "correct-password", "zipcode": 78704}`)
+
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(jsonStr))
+	m.Router.ServeHTTP(httptest.NewRecorder(), req)
+	followVerification(m, "memory@example.com")
+
+	req, _ = http.NewRequest("POST", "/signin", nil)
+	req.SetBasicAuth("Memory User", "correct-password")
+
+	response := httptest.NewRecorder()
+	m.Router.ServeHTTP(response, req)
+
+	tokens := Tokens{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &tokens))
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		req.Header.Set("If-Match", "*")
+
+		response := httptest.NewRecorder()
+		m.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	for id := 1; id <= 3; id++ {
+		assert.NoError(t, m.Inventory.SetStock(1253, id, 5))
+	}
+
+	response = send("POST", "/orders", `{"items": [{"id": 1, "name": "apple"}, {"id": 2, "name": "oranges"}]}`)
+	assert.JSONEq(t, `{"id":1,"user":"Memory User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1},{"id":2,"name":"oranges","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft","store_no":1253}`, response.Body.String())
+
+	response = send("PUT", "/orders/1", `{"items": [{"id": 1, "name": "apple"}, {"id": 3, "name": "avacado"}]}`)
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders/1", "")
+	assert.JSONEq(t, `{"id":1,"user":"Memory User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1},{"id":3,"name":"avacado","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft","store_no":1253}`, response.Body.String())
+
+	response = send("GET", "/orders", "")
+	assert.JSONEq(t, `{"orders":[{"id":1,"user":"Memory User","user_id":1,"items":[{"id":1,"name":"apple","quantity":1},{"id":3,"name":"avacado","quantity":1}],"subtotal":0,"tax_rate":0,"tax":0,"total":0,"status":"draft","store_no":1253}]}`, response.Body.String())
+
+	response = send("DELETE", "/orders/1", "")
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	response = send("GET", "/orders/1", "")
+	assertProblem(t, response, codeOrderNotFound, "Order not found.")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+}
+
+// newMemoryApp builds an App backed by MemoryRepository, without any database.
+func newMemoryApp() *App {
+	repository := NewMemoryRepository()
+	repository.AddItem(Item{ID: 1, Name: "apple"})
+	repository.AddItem(Item{ID: 2, Name: "oranges"})
+	repository.AddItem(Item{ID: 3, Name: "avacado"})
+
+	m := &App{
+		Users:        repository,
+		Orders:       repository,
+		Items:        repository,
+		Inventory:    repository,
+		Idempotency:  repository,
+		Sessions:     repository,
+		StoreLocator: a.StoreLocator,
+		Zipcodes:     a.Zipcodes,
+		TokenSecret:  []byte("memory-secret"),
+		Mailer:       mailed,
+	}
+	m.InitRouter()
+
+	return m
+}
+
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "franklin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "migrations.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	version, err := schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	// Applying again is a no-op.
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	assert.NoError(t, migrateDown(db, SQLite, len(migrations)))
+
+	version, err = schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	_, err = db.Exec("SELECT * FROM users")
+	assert.Error(t, err)
+
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	version, err = schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestMigrationsAdoptLegacyDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "franklin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "legacy.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(legacySchema + `
+INSERT INTO users(name, password, zip, store_lat, store_lon) VALUES('Legacy User', 'hash', 78704, 30.221033, -97.753926);
+INSERT INTO items(name) VALUES('apple');
+INSERT INTO orders(user_id) VALUES(1);
+INSERT INTO order_items(order_id, item_id) VALUES(1, 1);`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	version, err := schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	// Legacy users can still sign in and see their orders.
+	r := NewSQLRepository(db, SQLite)
+
+	u, hash, err := r.Credentials("Legacy User")
+	assert.NoError(t, err)
+	assert.Equal(t, User{ID: 1, Name: "Legacy User", Role: roleUser, Verified: true}, u)
+	assert.Equal(t, "hash", hash)
+
+	o := Order{ID: 1}
+	assert.NoError(t, r.GetOrder(&o, 1))
+	assert.Equal(t, statusPlaced, o.Status)
+	assert.Equal(t, []int{1}, o.getItemIDs())
+
+	assert.NoError(t, migrateDown(db, SQLite, len(migrations)))
+}
+
+// The committed franklin.db is what the app opens by default, so it has to
+// migrate as it ships. It is copied so the test leaves it untouched.
+func TestMigrationsAdoptCommittedDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "franklin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	committed, err := ioutil.ReadFile("franklin.db")
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, "franklin.db")
+	assert.NoError(t, ioutil.WriteFile(path, committed, 0600))
+
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	version, err := schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	u, _, err := NewSQLRepository(db, SQLite).Credentials("Test User")
+	assert.NoError(t, err)
+	assert.Equal(t, User{ID: 1, Name: "Test User", Role: roleUser, Verified: true}, u)
+}
+
+// legacySchema is the schema of the franklin.db committed before migrations
+// existed, as SQLite reports it.
+const legacySchema = `
+CREATE TABLE users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL
+, password TEXT, zip INTEGER, store_lat REAL, store_lon REAL);
+CREATE TABLE orders (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE TABLE items (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL
+);
+CREATE TABLE order_items (
+  order_id INTEGER NOT NULL,
+  item_id INTEGER NOT NULL,
+  FOREIGN KEY (order_id) REFERENCES orders(id),
+  FOREIGN KEY (item_id) REFERENCES items(id),
+  PRIMARY KEY (order_id, item_id)
+);`
+
+func clearUsersTable() {
+	_, err := a.DB.Exec("DELETE FROM users")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='users';")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearOrdersTable() {
+	_, err := a.DB.Exec("DELETE FROM order_transitions")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("DELETE FROM order_revisions")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("DELETE FROM orders")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='orders';")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearOrderItemsTable() {
+	_, err := a.DB.Exec("DELETE FROM order_items")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='order_items';")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearItemsTable() {
+	_, err := a.DB.Exec("DELETE FROM items")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='items';")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearInventoryTable() {
+	_, err := a.DB.Exec("DELETE FROM inventory")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearIdempotencyKeysTable() {
+	_, err := a.DB.Exec("DELETE FROM idempotency_keys")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearStoresTable() {
+	_, err := a.DB.Exec("DELETE FROM stores")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func clearRefreshTokensTable() {
+	_, err := a.DB.Exec("DELETE FROM refresh_tokens")
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = a.DB.Exec("UPDATE SQLITE_SEQUENCE SET SEQ=0 WHERE NAME='refresh_tokens';")
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func signin(t *testing.T) Tokens {
+	req, _ := http.NewRequest("POST", "/signin", nil)
+
+	req.SetBasicAuth("Test User", "correct-password")
+
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+
+	tokens := Tokens{}
+	if err := json.Unmarshal(response.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	return tokens
+}
+
+func setAuthentication() {
+	insertUser("Test User")
+}
+
+func insertUser(name string) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("correct-password"), 8)
+	if err != nil {
+		log.Error(err)
+	}
+
+	statement := fmt.Sprintf(`INSERT INTO users(name,password) VALUES('%s', '%s')`, name, hashedPassword)
+	_, err = a.DB.Exec(statement)
 	if err != nil {
 		log.Error(err)
 	}
 
 }
+
+func insertItems(names ...string) {
+	for _, name := range names {
+		_, err := a.DB.Exec("INSERT INTO items(name) VALUES($1)", name)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func setAdmin(name string) {
+	_, err := a.DB.Exec("UPDATE users SET role=$1 WHERE name=$2", roleAdmin, name)
+	if err != nil {
+		log.Error(err)
+	}
+}
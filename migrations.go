@@ -0,0 +1,588 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// migration is one versioned schema change. Up and Down may hold several
+// statements separated by semicolons, and are used for every dialect unless
+// PostgresUp and PostgresDown override them.
+type migration struct {
+	Version      int
+	Name         string
+	Up           string
+	Down         string
+	PostgresUp   string
+	PostgresDown string
+}
+
+func (m migration) script(d Dialect, up bool) string {
+	if d == Postgres {
+		if up && m.PostgresUp != "" {
+			return m.PostgresUp
+		}
+		if !up && m.PostgresDown != "" {
+			return m.PostgresDown
+		}
+	}
+
+	if up {
+		return m.Up
+	}
+	return m.Down
+}
+
+// migrations are applied in order and must never be edited once released,
+// add a new one instead.
+//
+// Version 1 is the baseline of the schema that used to live only in the
+// committed franklin.db. It uses IF NOT EXISTS so databases created before
+// migrations existed adopt it without changes.
+//
+// The Postgres scripts were added to released migrations when the backend
+// was, which is the one exception to the rule: no Postgres database predates
+// them, and SQLite databases keep running the scripts they always ran.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: `
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL,
+  password TEXT,
+  zip INTEGER,
+  store_lat REAL,
+  store_lon REAL
+);
+CREATE TABLE IF NOT EXISTS orders (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE TABLE IF NOT EXISTS items (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL
+);
+CREATE TABLE IF NOT EXISTS order_items (
+  order_id INTEGER NOT NULL,
+  item_id INTEGER NOT NULL,
+  FOREIGN KEY (order_id) REFERENCES orders(id),
+  FOREIGN KEY (item_id) REFERENCES items(id),
+  PRIMARY KEY (order_id, item_id)
+);`,
+		Down: `
+DROP TABLE order_items;
+DROP TABLE items;
+DROP TABLE orders;
+DROP TABLE users;`,
+		PostgresUp: `
+CREATE TABLE IF NOT EXISTS users (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  password TEXT,
+  zip INTEGER,
+  store_lat DOUBLE PRECISION,
+  store_lon DOUBLE PRECISION
+);
+CREATE TABLE IF NOT EXISTS orders (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id)
+);
+CREATE TABLE IF NOT EXISTS items (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL
+);
+CREATE TABLE IF NOT EXISTS order_items (
+  order_id INTEGER NOT NULL REFERENCES orders(id),
+  item_id INTEGER NOT NULL REFERENCES items(id),
+  PRIMARY KEY (order_id, item_id)
+);`,
+	},
+	{
+		Version: 2,
+		Name:    "user_roles",
+		Up: `
+ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'user';`,
+		// Older SQLite versions can not drop columns, so the table is rebuilt.
+		Down: `
+CREATE TABLE users_v1 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL,
+  password TEXT,
+  zip INTEGER,
+  store_lat REAL,
+  store_lon REAL
+);
+INSERT INTO users_v1(id, name, password, zip, store_lat, store_lon)
+  SELECT id, name, password, zip, store_lat, store_lon FROM users;
+DROP TABLE users;
+ALTER TABLE users_v1 RENAME TO users;`,
+		PostgresDown: `
+ALTER TABLE users DROP COLUMN role;`,
+	},
+	{
+		Version: 3,
+		Name:    "refresh_tokens",
+		Up: `
+CREATE TABLE refresh_tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires_at INTEGER NOT NULL,
+  revoked INTEGER NOT NULL DEFAULT 0,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);`,
+		Down: `
+DROP TABLE refresh_tokens;`,
+		PostgresUp: `
+CREATE TABLE refresh_tokens (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id),
+  token_hash TEXT NOT NULL UNIQUE,
+  expires_at BIGINT NOT NULL,
+  revoked INTEGER NOT NULL DEFAULT 0
+);`,
+	},
+	{
+		Version: 4,
+		Name:    "stores",
+		// Users from before stores were persisted only keep their coordinates.
+		Up: `
+CREATE TABLE stores (
+  no INTEGER PRIMARY KEY,
+  name VARCHAR(255),
+  street_address VARCHAR(255),
+  city VARCHAR(255),
+  state_prov_code VARCHAR(8),
+  zip VARCHAR(10),
+  country VARCHAR(8),
+  phone_number VARCHAR(32),
+  sunday_open INTEGER NOT NULL DEFAULT 0,
+  timezone VARCHAR(8),
+  longitude REAL,
+  latitude REAL
+);
+ALTER TABLE users ADD COLUMN store_no INTEGER REFERENCES stores(no);
+ALTER TABLE users ADD COLUMN store_distance REAL;`,
+		Down: `
+CREATE TABLE users_v3 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL,
+  password TEXT,
+  zip INTEGER,
+  store_lat REAL,
+  store_lon REAL,
+  role VARCHAR(32) NOT NULL DEFAULT 'user'
+);
+INSERT INTO users_v3(id, name, password, zip, store_lat, store_lon, role)
+  SELECT id, name, password, zip, store_lat, store_lon, role FROM users;
+DROP TABLE users;
+ALTER TABLE users_v3 RENAME TO users;
+DROP TABLE stores;`,
+		PostgresUp: `
+CREATE TABLE stores (
+  no INTEGER PRIMARY KEY,
+  name VARCHAR(255),
+  street_address VARCHAR(255),
+  city VARCHAR(255),
+  state_prov_code VARCHAR(8),
+  zip VARCHAR(10),
+  country VARCHAR(8),
+  phone_number VARCHAR(32),
+  sunday_open BOOLEAN NOT NULL DEFAULT FALSE,
+  timezone VARCHAR(8),
+  longitude DOUBLE PRECISION,
+  latitude DOUBLE PRECISION
+);
+ALTER TABLE users ADD COLUMN store_no INTEGER REFERENCES stores(no);
+ALTER TABLE users ADD COLUMN store_distance DOUBLE PRECISION;`,
+		PostgresDown: `
+ALTER TABLE users DROP COLUMN store_distance;
+ALTER TABLE users DROP COLUMN store_no;
+DROP TABLE stores;`,
+	},
+	{
+		Version: 5,
+		Name:    "item_catalog",
+		Up: `
+ALTER TABLE items ADD COLUMN sku VARCHAR(64);
+ALTER TABLE items ADD COLUMN description TEXT;
+ALTER TABLE items ADD COLUMN unit_price INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE items ADD COLUMN category VARCHAR(255);
+ALTER TABLE items ADD COLUMN archived INTEGER NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX items_sku ON items(sku);`,
+		Down: `
+DROP INDEX items_sku;
+CREATE TABLE items_v4 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL
+);
+INSERT INTO items_v4(id, name) SELECT id, name FROM items;
+DROP TABLE items;
+ALTER TABLE items_v4 RENAME TO items;`,
+		PostgresDown: `
+DROP INDEX items_sku;
+ALTER TABLE items DROP COLUMN archived;
+ALTER TABLE items DROP COLUMN category;
+ALTER TABLE items DROP COLUMN unit_price;
+ALTER TABLE items DROP COLUMN description;
+ALTER TABLE items DROP COLUMN sku;`,
+	},
+	{
+		Version: 6,
+		Name:    "order_lines",
+		// Existing lines are backfilled with the current catalog price.
+		Up: `
+ALTER TABLE order_items ADD COLUMN quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0);
+ALTER TABLE order_items ADD COLUMN unit_price INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN tax_rate INTEGER NOT NULL DEFAULT 0;
+UPDATE order_items SET unit_price=COALESCE((SELECT unit_price FROM items WHERE items.id=order_items.item_id), 0);`,
+		Down: `
+CREATE TABLE order_items_v5 (
+  order_id INTEGER NOT NULL,
+  item_id INTEGER NOT NULL,
+  FOREIGN KEY (order_id) REFERENCES orders(id),
+  FOREIGN KEY (item_id) REFERENCES items(id),
+  PRIMARY KEY (order_id, item_id)
+);
+INSERT INTO order_items_v5(order_id, item_id) SELECT order_id, item_id FROM order_items;
+DROP TABLE order_items;
+ALTER TABLE order_items_v5 RENAME TO order_items;
+CREATE TABLE orders_v5 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+INSERT INTO orders_v5(id, user_id) SELECT id, user_id FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_v5 RENAME TO orders;`,
+		PostgresDown: `
+ALTER TABLE orders DROP COLUMN tax_rate;
+ALTER TABLE order_items DROP COLUMN unit_price;
+ALTER TABLE order_items DROP COLUMN quantity;`,
+	},
+	{
+		Version: 7,
+		Name:    "order_status",
+		// Orders created before statuses existed were already submitted.
+		Up: `
+ALTER TABLE orders ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'draft';
+UPDATE orders SET status='placed';
+CREATE TABLE order_transitions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  order_id INTEGER NOT NULL,
+  from_status VARCHAR(32) NOT NULL,
+  to_status VARCHAR(32) NOT NULL,
+  created_at BIGINT NOT NULL,
+  FOREIGN KEY(order_id) REFERENCES orders(id)
+);
+CREATE INDEX order_transitions_order_id ON order_transitions(order_id);`,
+		Down: `
+DROP TABLE order_transitions;
+CREATE TABLE orders_v6 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  tax_rate INTEGER NOT NULL DEFAULT 0,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+INSERT INTO orders_v6(id, user_id, tax_rate) SELECT id, user_id, tax_rate FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_v6 RENAME TO orders;`,
+		PostgresUp: `
+ALTER TABLE orders ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'draft';
+UPDATE orders SET status='placed';
+CREATE TABLE order_transitions (
+  id SERIAL PRIMARY KEY,
+  order_id INTEGER NOT NULL REFERENCES orders(id),
+  from_status VARCHAR(32) NOT NULL,
+  to_status VARCHAR(32) NOT NULL,
+  created_at BIGINT NOT NULL
+);
+CREATE INDEX order_transitions_order_id ON order_transitions(order_id);`,
+		PostgresDown: `
+DROP TABLE order_transitions;
+ALTER TABLE orders DROP COLUMN status;`,
+	},
+	{
+		Version: 8,
+		Name:    "inventory",
+		Up: `
+CREATE TABLE inventory (
+  store_no INTEGER NOT NULL,
+  item_id INTEGER NOT NULL,
+  on_hand INTEGER NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+  reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0),
+  FOREIGN KEY (store_no) REFERENCES stores(no),
+  FOREIGN KEY (item_id) REFERENCES items(id),
+  PRIMARY KEY (store_no, item_id)
+);
+ALTER TABLE orders ADD COLUMN store_no INTEGER REFERENCES stores(no);`,
+		Down: `
+DROP TABLE inventory;
+CREATE TABLE orders_v7 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  tax_rate INTEGER NOT NULL DEFAULT 0,
+  status VARCHAR(32) NOT NULL DEFAULT 'draft',
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+INSERT INTO orders_v7(id, user_id, tax_rate, status) SELECT id, user_id, tax_rate, status FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_v7 RENAME TO orders;`,
+		PostgresDown: `
+DROP TABLE inventory;
+ALTER TABLE orders DROP COLUMN store_no;`,
+	},
+	{
+		Version: 9,
+		Name:    "idempotency_keys",
+		Up: `
+CREATE TABLE idempotency_keys (
+  user_id INTEGER NOT NULL,
+  idempotency_key VARCHAR(255) NOT NULL,
+  request_hash VARCHAR(64) NOT NULL,
+  status_code INTEGER NOT NULL DEFAULT 0,
+  response_body TEXT,
+  created_at BIGINT NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id),
+  PRIMARY KEY (user_id, idempotency_key)
+);`,
+		Down: `
+DROP TABLE idempotency_keys;`,
+	},
+	{
+		Version: 10,
+		Name:    "order_version",
+		Up: `
+ALTER TABLE orders ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+		Down: `
+CREATE TABLE orders_v9 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  tax_rate INTEGER NOT NULL DEFAULT 0,
+  status VARCHAR(32) NOT NULL DEFAULT 'draft',
+  store_no INTEGER REFERENCES stores(no),
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+INSERT INTO orders_v9(id, user_id, tax_rate, status, store_no) SELECT id, user_id, tax_rate, status, store_no FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_v9 RENAME TO orders;`,
+		PostgresDown: `
+ALTER TABLE orders DROP COLUMN version;`,
+	},
+	{
+		Version: 11,
+		Name:    "order_revisions",
+		// Revisions outlive their order, so they do not reference it.
+		Up: `
+CREATE TABLE order_revisions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  order_id INTEGER NOT NULL,
+  version INTEGER NOT NULL,
+  action VARCHAR(16) NOT NULL,
+  user_id INTEGER NOT NULL,
+  changes TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE INDEX order_revisions_order_id ON order_revisions(order_id);`,
+		Down: `
+DROP TABLE order_revisions;`,
+		PostgresUp: `
+CREATE TABLE order_revisions (
+  id SERIAL PRIMARY KEY,
+  order_id INTEGER NOT NULL,
+  version INTEGER NOT NULL,
+  action VARCHAR(16) NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users(id),
+  changes TEXT NOT NULL,
+  created_at BIGINT NOT NULL
+);
+CREATE INDEX order_revisions_order_id ON order_revisions(order_id);`,
+	},
+	{
+		Version: 12,
+		Name:    "order_soft_delete",
+		Up: `
+ALTER TABLE orders ADD COLUMN deleted_at BIGINT;
+CREATE INDEX orders_deleted_at ON orders(deleted_at);`,
+		// Orders that are only soft deleted would come back, so they are
+		// removed for good before the column goes.
+		Down: `
+DELETE FROM order_transitions WHERE order_id IN (SELECT id FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM order_items WHERE order_id IN (SELECT id FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM orders WHERE deleted_at IS NOT NULL;
+DROP INDEX orders_deleted_at;
+CREATE TABLE orders_v11 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  tax_rate INTEGER NOT NULL DEFAULT 0,
+  status VARCHAR(32) NOT NULL DEFAULT 'draft',
+  store_no INTEGER REFERENCES stores(no),
+  version INTEGER NOT NULL DEFAULT 1,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+INSERT INTO orders_v11(id, user_id, tax_rate, status, store_no, version) SELECT id, user_id, tax_rate, status, store_no, version FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_v11 RENAME TO orders;`,
+		PostgresDown: `
+DELETE FROM order_transitions WHERE order_id IN (SELECT id FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM order_items WHERE order_id IN (SELECT id FROM orders WHERE deleted_at IS NOT NULL);
+DELETE FROM orders WHERE deleted_at IS NOT NULL;
+ALTER TABLE orders DROP COLUMN deleted_at;`,
+	},
+	{
+		Version: 13,
+		Name:    "order_created_at",
+		// Orders with history are backfilled from their first revision, older
+		// ones are left at 0.
+		Up: `
+ALTER TABLE orders ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0;
+UPDATE orders SET created_at=COALESCE((SELECT MIN(created_at) FROM order_revisions WHERE order_revisions.order_id=orders.id), 0);
+CREATE INDEX orders_user_id_created_at ON orders(user_id, created_at);`,
+		Down: `
+DROP INDEX orders_user_id_created_at;
+CREATE TABLE orders_v12 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  tax_rate INTEGER NOT NULL DEFAULT 0,
+  status VARCHAR(32) NOT NULL DEFAULT 'draft',
+  store_no INTEGER REFERENCES stores(no),
+  version INTEGER NOT NULL DEFAULT 1,
+  deleted_at BIGINT,
+  FOREIGN KEY(user_id) REFERENCES users(id)
+);
+INSERT INTO orders_v12(id, user_id, tax_rate, status, store_no, version, deleted_at)
+  SELECT id, user_id, tax_rate, status, store_no, version, deleted_at FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_v12 RENAME TO orders;
+CREATE INDEX orders_deleted_at ON orders(deleted_at);`,
+		PostgresDown: `
+DROP INDEX orders_user_id_created_at;
+ALTER TABLE orders DROP COLUMN created_at;`,
+	},
+	{
+		Version: 14,
+		Name:    "user_email_verification",
+		// Existing accounts stay verified so they can still sign in; signups
+		// are inserted pending.
+		Up: `
+ALTER TABLE users ADD COLUMN email VARCHAR(255);
+ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 1;
+CREATE UNIQUE INDEX users_email ON users(email);`,
+		Down: `
+DROP INDEX users_email;
+CREATE TABLE users_v13 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL,
+  password TEXT,
+  zip INTEGER,
+  store_lat REAL,
+  store_lon REAL,
+  role VARCHAR(32) NOT NULL DEFAULT 'user',
+  store_no INTEGER REFERENCES stores(no),
+  store_distance REAL
+);
+INSERT INTO users_v13(id, name, password, zip, store_lat, store_lon, role, store_no, store_distance)
+  SELECT id, name, password, zip, store_lat, store_lon, role, store_no, store_distance FROM users;
+DROP TABLE users;
+ALTER TABLE users_v13 RENAME TO users;`,
+		PostgresDown: `
+DROP INDEX users_email;
+ALTER TABLE users DROP COLUMN verified;
+ALTER TABLE users DROP COLUMN email;`,
+	},
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	statement := `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  applied_at BIGINT NOT NULL
+)`
+	_, err := db.Exec(statement)
+	return err
+}
+
+// schemaVersion returns the highest applied migration, 0 for a fresh database.
+func schemaVersion(db *sql.DB) (int, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// migrateUp applies every pending migration, each in its own transaction.
+func migrateUp(db *sql.DB, d Dialect) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		if err := applyMigration(db, m, m.script(d, true), true); err != nil {
+			return fmt.Errorf("migration %d_%s up: %v", m.Version, m.Name, err)
+		}
+		log.Info("applied migration ", m.Version, "_", m.Name)
+	}
+
+	return nil
+}
+
+// migrateDown reverts the latest steps migrations.
+func migrateDown(db *sql.DB, d Dialect, steps int) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+
+		if err := applyMigration(db, m, m.script(d, false), false); err != nil {
+			return fmt.Errorf("migration %d_%s down: %v", m.Version, m.Name, err)
+		}
+		log.Info("reverted migration ", m.Version, "_", m.Name)
+		steps--
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration, script string, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(script); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_migrations(version, name, applied_at) VALUES($1, $2, $3)`, m.Version, m.Name, time.Now().Unix())
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version=$1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
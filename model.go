@@ -1,19 +1,51 @@
 package main
 
 import (
-	"database/sql"
-	"errors"
-	"strconv"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
 
-	"github.com/prometheus/common/log"
+// Order statuses, in the order an order normally moves through them.
+const (
+	statusDraft     = "draft"
+	statusPlaced    = "placed"
+	statusPicking   = "picking"
+	statusReady     = "ready_for_pickup"
+	statusCompleted = "completed"
+	statusCancelled = "cancelled"
 )
 
+// orderTransitions lists the statuses each status can move to. Completed and
+// cancelled orders are final.
+var orderTransitions = map[string][]string{
+	statusDraft:   {statusPlaced, statusCancelled},
+	statusPlaced:  {statusPicking, statusCancelled},
+	statusPicking: {statusReady, statusCancelled},
+	statusReady:   {statusCompleted, statusCancelled},
+}
+
 type User struct {
 	ID           int    `json:"id"`
 	Name         string `json:"name"`
+	Email        string `json:"email,omitempty"`
 	Password     string `json:"password,omitempty"`
+	Role         string `json:"role,omitempty"`
 	Zipcode      int    `json:"zipcode,omitempty"`
 	ClosestStore Store  `json:"closest_store,omitempty"`
+	// Verified is only set by following the link mailed on signup.
+	Verified bool `json:"-"`
+}
+
+type Users []User
+
+func (u User) isAdmin() bool {
+	return u.Role == roleAdmin
 }
 
 type Store struct {
@@ -28,33 +60,8 @@ type Store struct {
 	SundayOpen    bool      `json:"sundayOpen,omitempty"`
 	Timezone      string    `json:"timezone,omitempty"`
 	Zip           string    `json:"zip,omitempty"`
-}
-
-func (u *User) createUser(db *sql.DB) error {
-	statement := "INSERT INTO users(name,password,zip,store_lat,store_lon) VALUES(?, ?, ?, ?, ?)"
-
-	// NOTE: For simplicity, we are assuming that only storing the coordinates from the external API call is allowed.
-	result, err := db.Exec(statement, u.Name, u.Password, u.Zipcode, u.ClosestStore.Coordinates[0], u.ClosestStore.Coordinates[1])
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		return err
-	}
-
-  log.Info(id)
-
-	u.ID = int(id)
-	u.Password = ""
-	return err
-}
-
-func (u *User) getUser(db *sql.DB) error {
-	statement := `SELECT name,store_lat,store_lon FROM users WHERE id=$1`
-	var lat, lon float64
-	err := db.QueryRow(statement, u.ID).Scan(&u.Name, &lat, &lon)
-	u.ClosestStore.Coordinates = append(u.ClosestStore.Coordinates, lat)
-	u.ClosestStore.Coordinates = append(u.ClosestStore.Coordinates, lon)
-	return err
+	// Distance in miles from the user's zipcode centroid.
+	Distance float64 `json:"distance,omitempty"`
 }
 
 type Order struct {
@@ -62,269 +69,215 @@ type Order struct {
 	User   string `json:"user"`
 	UserID int    `json:"user_id"`
 	Items  `json:"items"`
+	// Amounts are in cents. TaxRate is in basis points and is captured with
+	// the order, like the unit price of each line.
+	Subtotal int    `json:"subtotal"`
+	TaxRate  int    `json:"tax_rate"`
+	Tax      int    `json:"tax"`
+	Total    int    `json:"total"`
+	Status   string `json:"status"`
+	// StoreNo is the store stock is reserved at, the user's closest store when
+	// the order was created. Orders of users without one reserve no stock.
+	StoreNo int `json:"store_no,omitempty"`
+	// Version goes up with every change to the order and is sent as its ETag.
+	Version int `json:"-"`
+	// Transitions are only loaded for a single order.
+	Transitions []Transition `json:"transitions,omitempty"`
 }
 
-type Orders []Order
+// Transition records when an order moved from one status to another.
+type Transition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
 
-type Items []Item
+const (
+	revisionCreated  = "created"
+	revisionUpdated  = "updated"
+	revisionDeleted  = "deleted"
+	revisionRestored = "restored"
+)
 
-type Item struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+// Revision is an immutable record of a change to an order's lines, kept even
+// after the order is deleted.
+type Revision struct {
+	Version int          `json:"version"`
+	Action  string       `json:"action"`
+	UserID  int          `json:"user_id"`
+	User    string       `json:"user"`
+	At      time.Time    `json:"at"`
+	Changes []LineChange `json:"changes"`
 }
 
-func (o *Order) createOrder(db *sql.DB) error {
-	statement := `INSERT INTO orders(user_id) VALUES($1)`
-	result, err := db.Exec(statement, o.UserID)
-	if err != nil {
-		log.Error("inserting to orders failed.")
-		return err
-	}
+// LineChange is the quantity of an item before and after a revision, 0 when
+// the line was not on the order.
+type LineChange struct {
+	ItemID int `json:"id"`
+	From   int `json:"from"`
+	To     int `json:"to"`
+}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return err
+// lineChanges diffs two sets of item quantities, in item order.
+func lineChanges(before, after map[int]int) []LineChange {
+	var ids []int
+	for id := range before {
+		ids = append(ids, id)
 	}
-
-	o.ID = int(id)
-
-	statement = `INSERT INTO order_items(order_id, item_id) VALUES($1, $2)`
-	for _, item := range o.Items {
-		_, err = db.Exec(statement, o.ID, item.ID)
-		if err != nil {
-			log.Error("inserting to order_items failed.")
-			return err
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
 		}
 	}
+	sort.Ints(ids)
 
-	return nil
-}
-
-func (o *Order) getOrder(db *sql.DB, userID string) error {
-
-	statement := `SELECT users.name, order_items.item_id, items.name FROM orders 
-  INNER JOIN order_items ON order_items.order_id=orders.id
-  INNER JOIN items ON order_items.item_id=items.id
-  INNER JOIN users ON orders.user_id=users.id
-  WHERE orders.id=$1 AND users.id=$2
-  `
-
-	rows, err := db.Query(statement, o.ID, userID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	defer rows.Close()
-
-	i := Item{}
-
-	if rows.Next() {
-		err = rows.Scan(&o.User, &i.ID, &i.Name)
-		if err != nil {
-			log.Error(err)
-			return err
+	changes := []LineChange{}
+	for _, id := range ids {
+		if before[id] != after[id] {
+			changes = append(changes, LineChange{ItemID: id, From: before[id], To: after[id]})
 		}
-		o.Items = append(o.Items, i)
-		for rows.Next() {
-			err = rows.Scan(&o.User, &i.ID, &i.Name)
-			if err != nil {
-				log.Error(err)
-				return err
-			}
-			o.Items = append(o.Items, i)
-		}
-	} else {
-		e := errors.New("No DB results found")
-		log.Error(e)
-		return e
 	}
-
-	return nil
+	return changes
 }
 
-func getOrders(db *sql.DB, userID string, count, start int) (Orders, error) {
-
-	statement := `SELECT orders.id FROM orders 
-  INNER JOIN users ON orders.user_id=users.id
-  WHERE users.id=$1 ORDER BY orders.id DESC LIMIT $2 OFFSET $3;
-  `
-
-	rows, err := db.Query(statement, userID, count, start)
-	if err != nil {
-		log.Error(err)
-		if err == sql.ErrNoRows {
-			e := errors.New("No DB results found")
-			log.Error(e)
-			return nil, err
-		}
-	}
-	defer rows.Close()
-
-	var orders Orders
-	var orderIDs []int
-	var oID int
-
-	// FIXME: Isn't there a cleaner way? needs serious refactoring
-	if rows.Next() {
-		err = rows.Scan(&oID)
-		if err != nil {
-			log.Error(err)
-			return nil, err
-		}
+// Orders can be listed newest or oldest first, or by total.
+const (
+	sortNewest    = "-created_at"
+	sortOldest    = "created_at"
+	sortTotalDesc = "-total"
+	sortTotal     = "total"
+)
 
-		orderIDs = append(orderIDs, oID)
+// OrderQuery selects a page of a user's orders.
+type OrderQuery struct {
+	Limit int
+	// After continues from the last order of the previous page, which must
+	// have been listed with the same Sort. Offset is only used without it.
+	After    *OrderCursor
+	Offset   int
+	Sort     string
+	Statuses []string
+	// From and To bound when the order was created, From inclusive and To
+	// exclusive. Zero values leave the range open.
+	From   time.Time
+	To     time.Time
+	ItemID int
+}
 
-		for rows.Next() {
-			err = rows.Scan(&oID)
-			if err != nil {
-				log.Error(err)
-				return nil, err
-			}
+// OrderCursor is the position of an order in a listing: the value it is
+// sorted by and its id, which breaks ties.
+type OrderCursor struct {
+	Key int64 `json:"k"`
+	ID  int   `json:"id"`
+}
 
-			orderIDs = append(orderIDs, oID)
-		}
-	} else {
-		e := errors.New("No DB results found")
-		log.Error(e)
-		return nil, e
+func validSort(sort string) bool {
+	switch sort {
+	case sortNewest, sortOldest, sortTotalDesc, sortTotal:
+		return true
 	}
+	return false
+}
 
-	for _, oID := range orderIDs {
+type Orders []Order
 
-		statement := `SELECT users.name, order_items.item_id, items.name FROM orders 
-  INNER JOIN order_items ON order_items.order_id=orders.id
-  INNER JOIN items ON order_items.item_id=items.id
-  INNER JOIN users ON orders.user_id=users.id
-  WHERE orders.id=$1 AND users.id=$2;
-  `
+type Items []Item
 
-		rows, err := db.Query(statement, oID, userID)
-		if err != nil {
-			log.Error(err)
-			return nil, err
-		}
-		defer rows.Close()
-
-		o := Order{}
-		i := Item{}
-
-		if rows.Next() {
-			err = rows.Scan(&o.User, &i.ID, &i.Name)
-			if err != nil {
-				log.Error(err)
-				return nil, err
-			}
-			o.Items = append(o.Items, i)
-			o.ID = oID
-			o.UserID, _ = strconv.Atoi(userID)
-			for rows.Next() {
-				err = rows.Scan(&o.User, &i.ID, &i.Name)
-				if err != nil {
-					log.Error(err)
-					return nil, err
-				}
-				o.Items = append(o.Items, i)
-				o.ID = oID
-				o.UserID, _ = strconv.Atoi(userID)
-			}
-		} else {
-			e := errors.New("No DB results found")
-			log.Error(e)
-			return nil, e
-		}
+type Item struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	SKU         string `json:"sku,omitempty"`
+	Description string `json:"description,omitempty"`
+	// UnitPrice is in cents.
+	UnitPrice int    `json:"unit_price,omitempty"`
+	Category  string `json:"category,omitempty"`
+	Archived  bool   `json:"archived,omitempty"`
+	// Quantity and LineTotal are only set on the lines of an order, where
+	// UnitPrice is the price captured when the line was added.
+	Quantity  int `json:"quantity,omitempty"`
+	LineTotal int `json:"line_total,omitempty"`
+}
 
-		orders = append(orders, o)
-	}
+// Stock is the inventory of an item at a store. Reserved units are held by
+// open orders, Available is what is left to order.
+type Stock struct {
+	StoreNo   int `json:"store_no"`
+	ItemID    int `json:"item_id"`
+	OnHand    int `json:"on_hand"`
+	Reserved  int `json:"reserved"`
+	Available int `json:"available"`
+}
 
-	return orders, nil
+// Shortage is an order line the store does not have enough stock for.
+type Shortage struct {
+	ItemID    int `json:"id"`
+	Requested int `json:"requested"`
+	Available int `json:"available"`
 }
 
-// FIXME: This needs to be transaction based
-func (o *Order) updateOrder(db *sql.DB) error {
+// insufficientStockError lists the lines of an order that could not be
+// reserved.
+type insufficientStockError struct {
+	Items []Shortage
+}
 
-	statement := `SELECT item_id FROM order_items WHERE order_id=?`
-	rows, err := db.Query(statement, o.ID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	defer rows.Close()
+func (e *insufficientStockError) Error() string {
+	return fmt.Sprintf("Insufficient stock: %v", e.Items)
+}
 
-	var existing []int
-	var eid int
+// invalidItemsError lists the items of an order that are not in the catalog
+// or have been archived.
+type invalidItemsError struct {
+	IDs []int
+}
 
-	if rows.Next() {
-		err = rows.Scan(&eid)
-		if err != nil {
-			log.Error(err)
-			return err
-		}
+func (e *invalidItemsError) Error() string {
+	return fmt.Sprintf("Items are unknown or archived: %v", e.IDs)
+}
 
-		existing = append(existing, eid)
-		for rows.Next() {
-			err = rows.Scan(&eid)
-			if err != nil {
-				log.Error(err)
-				return err
-			}
+// invalidTransitionError is returned when an order can not move to a status.
+type invalidTransitionError struct {
+	From string
+	To   string
+}
 
-			existing = append(existing, eid)
-		}
+func (e *invalidTransitionError) Error() string {
+	return fmt.Sprintf("Order can not move from %s to %s", e.From, e.To)
+}
 
-	} else {
-		e := errors.New("Order not found.")
-		log.Error(e)
-		return e
+func validStatus(status string) bool {
+	switch status {
+	case statusDraft, statusPlaced, statusPicking, statusReady, statusCompleted, statusCancelled:
+		return true
 	}
+	return false
+}
 
-	desired := o.getItemIDs()
-
-	dels := compare(existing, desired)
-	adds := compare(desired, existing)
+// editable reports whether the order's items can still be changed or the
+// order deleted, which stops once it is being picked.
+func (o *Order) editable() bool {
+	return o.Status == statusDraft || o.Status == statusPlaced
+}
 
-	statement = `INSERT INTO order_items(order_id, item_id) VALUES($1, $2)`
-	for _, addID := range adds {
-		_, err = db.Exec(statement, o.ID, addID)
-		if err != nil {
-			log.Error("inserting to order_items failed.")
-			return err
+// canTransition reports whether an order may move between the statuses.
+// Customers can only place or cancel their own orders while they are still
+// editable; staff drive the rest of the fulfilment.
+func canTransition(from, to string, staff bool) bool {
+	if !staff {
+		if from != statusDraft && from != statusPlaced {
+			return false
 		}
-	}
-
-	statement = `DELETE FROM order_items WHERE order_id=? AND item_id=?;`
-	for _, delID := range dels {
-		_, err = db.Exec(statement, o.ID, delID)
-		if err != nil {
-			log.Error("deleting from order_items failed.")
-			return err
+		if to != statusPlaced && to != statusCancelled {
+			return false
 		}
 	}
 
-	// Verify the results
-	statement = `SELECT COUNT(item_id) FROM order_items WHERE order_id=?`
-	rows, err = db.Query(statement, o.ID)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	defer rows.Close()
-
-	var count int
-	for rows.Next() {
-		err = rows.Scan(&count)
-		if err != nil {
-			log.Error(err)
-			return err
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
 		}
 	}
-
-	if count != len(desired) {
-		e := errors.New("Incorrect updates on order_items.")
-		log.Info(e)
-		return e
-	}
-
-	return nil
+	return false
 }
 
 func (o *Order) getItemIDs() []int {
@@ -335,26 +288,43 @@ func (o *Order) getItemIDs() []int {
 	return ids
 }
 
-func (o *Order) deleteOrder(db *sql.DB) error {
-
-	statement := `DELETE FROM orders WHERE user_id =? AND id=?`
-	result, err := db.Exec(statement, o.UserID, o.ID)
-	if err != nil {
-		log.Error("deleting from orders failed: ", err)
-		return err
+// lines maps the order's item ids to their quantities, which default to 1.
+func (o *Order) lines() map[int]int {
+	lines := make(map[int]int)
+	for _, item := range o.Items {
+		quantity := item.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		lines[item.ID] += quantity
 	}
+	return lines
+}
 
-	number, err := result.RowsAffected()
-	if err != nil {
-		log.Error(err)
-		return err
+// duplicateLines is the validation error for items listed on more than one
+// line, nil when every item has a single line.
+func (o *Order) duplicateLines() error {
+	seen := make(map[int]bool)
+	var checks []check
+	for i, item := range o.Items {
+		checks = append(checks, field(fmt.Sprintf("items[%d].id", i), unique(item.ID, seen)))
 	}
+	return validationError("Order is invalid.", validate(checks...))
+}
 
-	if int(number) == 0 {
-		e := errors.New("Order doesn't exist.")
-		log.Error(e)
-		return e
+// price fills in the line totals, subtotal, tax and total from the quantities
+// and unit prices already set on the lines. Tax is rounded half up.
+func (o *Order) price() {
+	o.Subtotal = 0
+	for i := range o.Items {
+		line := &o.Items[i]
+		if line.Quantity == 0 {
+			line.Quantity = 1
+		}
+		line.LineTotal = line.Quantity * line.UnitPrice
+		o.Subtotal += line.LineTotal
 	}
 
-	return nil
+	o.Tax = (o.Subtotal*o.TaxRate + 5000) / 10000
+	o.Total = o.Subtotal + o.Tax
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	jsonPatchType  = "application/json-patch+json"
+	mergePatchType = "application/merge-patch+json"
+)
+
+// errPatchTestFailed is returned when a JSON Patch test operation does not
+// hold, so none of the patch is applied.
+var errPatchTestFailed = errors.New("Patch test failed.")
+
+// invalidPatchError is returned for patches that are well formed but can not
+// be applied to an order.
+type invalidPatchError struct {
+	Reason string
+}
+
+func (e *invalidPatchError) Error() string {
+	return "Patch is invalid: " + e.Reason
+}
+
+// patchOperation is a single RFC 6902 operation.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies an RFC 6902 patch to the lines of an order, in the
+// order they are returned by GET. Only the items can be patched:
+//
+//	{"op":"add","path":"/items/-","value":{"id":3,"quantity":2}}
+//	{"op":"remove","path":"/items/0"}
+//	{"op":"replace","path":"/items/1/quantity","value":4}
+//	{"op":"test","path":"/items/1/id","value":2}
+//
+// The operations apply in sequence to a copy, so a failing one leaves the
+// lines untouched. Quantities a patch sets must be at least 1.
+func applyJSONPatch(lines Items, patch []byte) (Items, error) {
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+
+	patched := append(Items(nil), lines...)
+	for _, op := range ops {
+		index, field, err := patchPath(op.Path, len(patched), op.Op == "add")
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case op.Op == "add" && field == "":
+			line, err := patchLine(op.Value, index)
+			if err != nil {
+				return nil, err
+			}
+			if lineIndex(patched, line.ID) >= 0 {
+				return nil, &invalidPatchError{fmt.Sprintf("item %d is already on the order", line.ID)}
+			}
+			patched = append(patched[:index], append(Items{line}, patched[index:]...)...)
+
+		case op.Op == "remove" && field == "":
+			patched = append(patched[:index], patched[index+1:]...)
+
+		case op.Op == "replace" && field == "":
+			line, err := patchLine(op.Value, index)
+			if err != nil {
+				return nil, err
+			}
+			if other := lineIndex(patched, line.ID); other >= 0 && other != index {
+				return nil, &invalidPatchError{fmt.Sprintf("item %d is already on the order", line.ID)}
+			}
+			patched[index] = line
+
+		case (op.Op == "add" || op.Op == "replace") && field == "quantity":
+			var quantity int
+			if err := json.Unmarshal(op.Value, &quantity); err != nil {
+				return nil, &invalidPatchError{"quantity must be a number"}
+			}
+			if err := patchQuantity(index, &quantity); err != nil {
+				return nil, err
+			}
+			patched[index].Quantity = quantity
+
+		case op.Op == "test":
+			var expected interface{}
+			if err := json.Unmarshal(op.Value, &expected); err != nil {
+				return nil, &invalidPatchError{"test needs a value"}
+			}
+			if !patchTest(patched[index], field, expected) {
+				return nil, errPatchTestFailed
+			}
+
+		default:
+			return nil, &invalidPatchError{fmt.Sprintf("%s of %s is not supported", op.Op, op.Path)}
+		}
+	}
+
+	return patched, nil
+}
+
+// patchPath resolves a JSON Pointer into an order's lines to the index of the
+// line and the field of it, if any. "-" points past the last line and is only
+// valid for adds.
+func patchPath(path string, count int, add bool) (int, string, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "" || parts[1] != "items" {
+		return 0, "", &invalidPatchError{fmt.Sprintf("path %q is not an order line", path)}
+	}
+
+	field := ""
+	if len(parts) == 4 {
+		field = parts[3]
+		if field != "id" && field != "quantity" {
+			return 0, "", &invalidPatchError{fmt.Sprintf("path %q is not an order line", path)}
+		}
+	}
+
+	max := count - 1
+	if add && field == "" {
+		max = count
+	}
+
+	if parts[2] == "-" && add && field == "" {
+		return count, field, nil
+	}
+
+	index, err := strconv.Atoi(parts[2])
+	if err != nil || index < 0 || index > max || (parts[2] != "0" && parts[2][0] == '0') {
+		return 0, "", &invalidPatchError{fmt.Sprintf("path %q is not an order line", path)}
+	}
+
+	return index, field, nil
+}
+
+// lineIndex returns where the item is among the lines, -1 if it is not.
+func lineIndex(lines Items, id int) int {
+	for i, line := range lines {
+		if line.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// patchLine reads a whole line of a patch, to go at index. Without a
+// quantity it is 1, as for new orders.
+func patchLine(value json.RawMessage, index int) (Item, error) {
+	var line struct {
+		ID       int    `json:"id"`
+		Name     string `json:"name"`
+		Quantity *int   `json:"quantity"`
+	}
+	if err := json.Unmarshal(value, &line); err != nil || line.ID == 0 {
+		return Item{}, &invalidPatchError{"order lines need an id"}
+	}
+	if err := patchQuantity(index, line.Quantity); err != nil {
+		return Item{}, err
+	}
+
+	patched := Item{ID: line.ID, Name: line.Name}
+	if line.Quantity != nil {
+		patched.Quantity = *line.Quantity
+	}
+	return patched, nil
+}
+
+// patchQuantity is the validation error for a quantity a patch sets on the
+// line at index, if any. Unlike a line without one, an explicit 0 is not
+// read as 1: the client asked for none and would get one.
+func patchQuantity(index int, quantity *int) error {
+	if quantity == nil {
+		return nil
+	}
+	return validationError("Order is invalid.", validate(field(fmt.Sprintf("items[%d].quantity", index), atLeast(*quantity, 1))))
+}
+
+// patchTest compares a line, or one of its fields, with the value of a test
+// operation. Quantities compare as the order would store them.
+func patchTest(line Item, field string, expected interface{}) bool {
+	quantity := line.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+
+	switch field {
+	case "id":
+		return expected == float64(line.ID)
+	case "quantity":
+		return expected == float64(quantity)
+	}
+
+	fields, ok := expected.(map[string]interface{})
+	if !ok || fields["id"] != float64(line.ID) {
+		return false
+	}
+	if q, ok := fields["quantity"]; ok && q != float64(quantity) {
+		return false
+	}
+	return true
+}
+
+// applyMergePatch applies an RFC 7396 merge patch to the lines of an order.
+// As an array would replace every line, items may instead be an object keyed
+// by item id, where null removes the line and an object adds or updates it:
+//
+//	{"items": {"3": {"quantity": 2}, "1": null}}
+//
+// An items array still replaces the lines as a whole. Either way quantities
+// the patch sets must be at least 1.
+func applyMergePatch(lines Items, patch []byte) (Items, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &doc); err != nil {
+		return nil, err
+	}
+
+	for key := range doc {
+		if key != "items" {
+			return nil, &invalidPatchError{fmt.Sprintf("%s can not be patched", key)}
+		}
+	}
+
+	raw, ok := doc["items"]
+	if !ok {
+		return lines, nil
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var replaced Items
+		if err := json.Unmarshal(raw, &replaced); err != nil {
+			return nil, err
+		}
+
+		var quantities []struct {
+			Quantity *int `json:"quantity"`
+		}
+		if err := json.Unmarshal(raw, &quantities); err != nil {
+			return nil, err
+		}
+		for i, line := range quantities {
+			if err := patchQuantity(i, line.Quantity); err != nil {
+				return nil, err
+			}
+		}
+		return replaced, nil
+	}
+
+	var changes map[string]*struct {
+		Name     string `json:"name"`
+		Quantity *int   `json:"quantity"`
+	}
+	if err := json.Unmarshal(raw, &changes); err != nil || changes == nil {
+		return nil, &invalidPatchError{"items must be an array or an object keyed by item id"}
+	}
+
+	// Apply in id order, so the result does not depend on map iteration.
+	byID := make(map[int]string)
+	var ids []int
+	for key := range changes {
+		id, err := strconv.Atoi(key)
+		if err != nil || id < 1 {
+			return nil, &invalidPatchError{fmt.Sprintf("%q is not an item id", key)}
+		}
+		if _, ok := byID[id]; ok {
+			return nil, &invalidPatchError{fmt.Sprintf("item %d is listed twice", id)}
+		}
+		byID[id] = key
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	patched := append(Items(nil), lines...)
+	for _, id := range ids {
+		change := changes[byID[id]]
+		index := lineIndex(patched, id)
+
+		switch {
+		case change == nil && index >= 0:
+			patched = append(patched[:index], patched[index+1:]...)
+		case change == nil:
+			// Removing a line that is not there is a no-op.
+		case index >= 0:
+			if err := patchQuantity(index, change.Quantity); err != nil {
+				return nil, err
+			}
+			if change.Quantity != nil {
+				patched[index].Quantity = *change.Quantity
+			}
+		default:
+			if err := patchQuantity(len(patched), change.Quantity); err != nil {
+				return nil, err
+			}
+			line := Item{ID: id, Name: change.Name}
+			if change.Quantity != nil {
+				line.Quantity = *change.Quantity
+			}
+			patched = append(patched, line)
+		}
+	}
+
+	return patched, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	defaultRestoreWindow  = 7 * 24 * time.Hour
+	defaultOrderRetention = 30 * 24 * time.Hour
+)
+
+// durationEnv reads a duration like "72h" from the environment, falling back
+// when it is not set.
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatal(name, " must be a positive duration like 72h: ", value)
+	}
+	return d
+}
+
+// purgeOrders removes deleted orders for good once their retention expired,
+// every interval for as long as the process runs.
+func (a *App) purgeOrders(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.purgeExpiredOrders()
+	}
+}
+
+func (a *App) purgeExpiredOrders() {
+	purged, err := a.Orders.PurgeOrders(time.Now().Add(-a.OrderRetention))
+	if err != nil {
+		log.Error("purging deleted orders failed: ", err)
+		return
+	}
+
+	if purged > 0 {
+		log.Info("purged deleted orders: ", purged)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// errDuplicateSKU is returned when an item's SKU is already in the catalog.
+	errDuplicateSKU = errors.New("SKU already exists.")
+	// errDuplicateEmail is returned when a signup uses the email address of
+	// another account.
+	errDuplicateEmail = errors.New("Email address is already registered.")
+	// errOrderLocked is returned when an order is changed after it started
+	// being picked.
+	errOrderLocked = errors.New("Order can no longer be changed.")
+	// errStockReserved is returned when stock is set below what open orders
+	// have reserved.
+	errStockReserved = errors.New("Stock can not go below what is reserved.")
+	// errStaleOrder is returned when an order changed since the version the
+	// caller read.
+	errStaleOrder = errors.New("Order has been changed since it was read.")
+	// errRestoreExpired is returned when an order was deleted too long ago to
+	// be restored.
+	errRestoreExpired = errors.New("Order can no longer be restored.")
+	// errOrderNotFound is returned when the user has no such order, or it was
+	// deleted.
+	errOrderNotFound = errors.New("Order not found.")
+	// errEmptyOrder is returned when an order without items is placed. Only
+	// drafts can be empty.
+	errEmptyOrder = errors.New("Order has no items.")
+)
+
+// UserRepository persists users and looks up their credentials.
+type UserRepository interface {
+	CreateUser(u *User) error
+	GetUser(u *User) error
+	GetUsers(count, start int) (Users, error)
+	// Credentials returns the user and their password hash, or sql.ErrNoRows
+	// when no user has that name.
+	Credentials(name string) (User, string, error)
+	// VerifyEmail marks the user verified if email is still their address,
+	// sql.ErrNoRows otherwise. Verifying twice is not an error.
+	VerifyEmail(id int, email string) error
+	// UnverifiedUser finds the account pending verification of email, or
+	// sql.ErrNoRows.
+	UnverifiedUser(email string) (User, error)
+}
+
+// OrderRepository persists orders, always scoped to their owner. Orders the
+// owner can not see are errOrderNotFound.
+type OrderRepository interface {
+	CreateOrder(o *Order) error
+	// GetOrder reads the order and its items, an empty Items for drafts
+	// without any.
+	GetOrder(o *Order, userID int) error
+	// GetOrders returns a page of the user's orders and, when there are more,
+	// the cursor of the last one. An empty page is not an error.
+	GetOrders(userID int, q OrderQuery) (Orders, *OrderCursor, error)
+	// UpdateOrder and DeleteOrder return errStaleOrder unless the order is
+	// still at o.Version; a zero o.Version skips the check. Every change,
+	// transitions included, bumps the version.
+	UpdateOrder(o *Order) error
+	// DeleteOrder only marks the order deleted, from then on it is not found
+	// until it is restored.
+	DeleteOrder(o *Order) error
+	// TransitionOrder moves the order to a new status and records when. A zero
+	// o.UserID reaches any order and allows the staff transitions.
+	TransitionOrder(o *Order, to string) error
+	// OrderHistory lists the revisions of the order, oldest first, also once
+	// it is deleted. A zero userID reaches any order.
+	OrderHistory(orderID, userID int) ([]Revision, error)
+	// RestoreOrder undoes the deletion of an order deleted after since, and
+	// reserves its stock again.
+	RestoreOrder(o *Order, since time.Time) error
+	// PurgeOrders removes the orders deleted before the time for good and
+	// returns how many there were. Their history is kept.
+	PurgeOrders(before time.Time) (int, error)
+}
+
+// ItemRepository persists the item catalog. Items are archived rather than
+// deleted, since past orders still reference them.
+type ItemRepository interface {
+	CreateItem(i *Item) error
+	GetItem(i *Item) error
+	GetItems(count, start int, archived bool) (Items, error)
+	UpdateItem(i *Item) error
+	ArchiveItem(id int) error
+}
+
+// InventoryRepository persists the stock of items at each store. Orders
+// reserve stock through OrderRepository.
+type InventoryRepository interface {
+	// SetStock sets the units on hand, returning sql.ErrNoRows when the store
+	// or item is unknown.
+	SetStock(storeNo, itemID, onHand int) error
+	GetInventory(storeNo int) ([]Stock, error)
+}
+
+// IdempotencyRepository remembers the responses to requests sent with an
+// Idempotency-Key, per user, so retries are answered without running again.
+type IdempotencyRepository interface {
+	// BeginIdempotent claims the key for the request. If the key is already
+	// claimed it returns false and the stored request, whose StatusCode is 0
+	// while it is still running. Keys expire after idempotencyKeyTTL.
+	BeginIdempotent(userID int, key, requestHash string) (IdempotentRequest, bool, error)
+	CompleteIdempotent(userID int, key string, code int, body []byte) error
+	// AbandonIdempotent releases a claimed key so the request can be retried.
+	AbandonIdempotent(userID int, key string) error
+}
+
+// SessionRepository persists the refresh tokens behind signed in sessions.
+type SessionRepository interface {
+	CreateSession(userID int, tokenHash string, expiresAt time.Time) (int, error)
+	RedeemSession(tokenHash string) (User, error)
+	RevokeSession(id int) error
+	SessionActive(id int) (bool, error)
+}
+
+var (
+	_ UserRepository        = (*SQLRepository)(nil)
+	_ OrderRepository       = (*SQLRepository)(nil)
+	_ ItemRepository        = (*SQLRepository)(nil)
+	_ InventoryRepository   = (*SQLRepository)(nil)
+	_ IdempotencyRepository = (*SQLRepository)(nil)
+	_ SessionRepository     = (*SQLRepository)(nil)
+
+	_ UserRepository        = (*MemoryRepository)(nil)
+	_ OrderRepository       = (*MemoryRepository)(nil)
+	_ ItemRepository        = (*MemoryRepository)(nil)
+	_ InventoryRepository   = (*MemoryRepository)(nil)
+	_ IdempotencyRepository = (*MemoryRepository)(nil)
+	_ SessionRepository     = (*MemoryRepository)(nil)
+)
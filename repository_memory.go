@@ -0,0 +1,909 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository implements the repositories in memory. It mirrors the
+// behaviour of SQLRepository, errors included, so handlers can be exercised
+// without a database file.
+type MemoryRepository struct {
+	mu sync.Mutex
+
+	users     map[int]User
+	passwords map[int]string
+	stores    map[int]Store
+	items     map[int]Item
+	orders    map[int]memoryOrder
+	sessions  map[int]memorySession
+	inventory map[stockKey]Stock
+	requests  map[requestKey]IdempotentRequest
+	revisions map[int][]Revision
+
+	lastUserID    int
+	lastItemID    int
+	lastOrderID   int
+	lastSessionID int
+}
+
+type memoryOrder struct {
+	userID      int
+	taxRate     int
+	storeNo     int
+	status      string
+	version     int
+	createdAt   int64
+	deletedAt   time.Time
+	transitions []Transition
+	lines       []memoryLine
+}
+
+type stockKey struct {
+	storeNo int
+	itemID  int
+}
+
+type requestKey struct {
+	userID int
+	key    string
+}
+
+type memoryLine struct {
+	itemID    int
+	quantity  int
+	unitPrice int
+}
+
+type memorySession struct {
+	userID    int
+	tokenHash string
+	expiresAt time.Time
+	revoked   bool
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:     map[int]User{},
+		passwords: map[int]string{},
+		stores:    map[int]Store{},
+		items:     map[int]Item{},
+		orders:    map[int]memoryOrder{},
+		sessions:  map[int]memorySession{},
+		inventory: map[stockKey]Stock{},
+		requests:  map[requestKey]IdempotentRequest{},
+		revisions: map[int][]Revision{},
+	}
+}
+
+// AddItem seeds the item catalog orders are resolved against.
+func (m *MemoryRepository) AddItem(i Item) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items[i.ID] = i
+	if i.ID > m.lastItemID {
+		m.lastItemID = i.ID
+	}
+}
+
+func (m *MemoryRepository) CreateItem(i *Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.skuTaken(i.SKU, 0) {
+		return errDuplicateSKU
+	}
+
+	m.lastItemID++
+	i.ID = m.lastItemID
+	i.Archived = false
+	m.items[i.ID] = *i
+
+	return nil
+}
+
+func (m *MemoryRepository) GetItem(i *Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[i.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	*i = stored
+	return nil
+}
+
+func (m *MemoryRepository) GetItems(count, start int, archived bool) (Items, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, i := range m.items {
+		if archived || !i.Archived {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	items := Items{}
+	for _, id := range page(ids, count, start) {
+		items = append(items, m.items[id])
+	}
+
+	return items, nil
+}
+
+func (m *MemoryRepository) UpdateItem(i *Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[i.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if m.skuTaken(i.SKU, i.ID) {
+		return errDuplicateSKU
+	}
+
+	i.Archived = stored.Archived
+	m.items[i.ID] = *i
+
+	return nil
+}
+
+func (m *MemoryRepository) ArchiveItem(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	stored.Archived = true
+	m.items[id] = stored
+
+	return nil
+}
+
+func (m *MemoryRepository) skuTaken(sku string, id int) bool {
+	if sku == "" {
+		return false
+	}
+
+	for _, i := range m.items {
+		if i.SKU == sku && i.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkItems mirrors SQLRepository's rejection of unknown and archived items.
+func (m *MemoryRepository) checkItems(ids []int) error {
+	var invalid []int
+	for _, id := range ids {
+		if i, ok := m.items[id]; !ok || i.Archived {
+			invalid = append(invalid, id)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return &invalidItemsError{IDs: invalid}
+	}
+	return nil
+}
+
+func (m *MemoryRepository) CreateUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u.Email != "" {
+		for _, stored := range m.users {
+			if stored.Email == u.Email {
+				return errDuplicateEmail
+			}
+		}
+	}
+
+	store := u.ClosestStore
+	store.Distance = 0
+	m.stores[store.No] = store
+
+	m.lastUserID++
+	u.ID = m.lastUserID
+
+	m.passwords[u.ID] = u.Password
+	u.Password = ""
+	u.Verified = false
+	m.users[u.ID] = *u
+
+	return nil
+}
+
+func (m *MemoryRepository) GetUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[u.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	u.Name = stored.Name
+	u.Email = stored.Email
+	u.Role = stored.Role
+	u.ClosestStore = m.stores[stored.ClosestStore.No]
+	u.ClosestStore.Distance = stored.ClosestStore.Distance
+
+	return nil
+}
+
+func (m *MemoryRepository) GetUsers(count, start int) (Users, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	users := Users{}
+	for _, id := range page(ids, count, start) {
+		stored := m.users[id]
+		users = append(users, User{ID: stored.ID, Name: stored.Name, Role: stored.Role, Zipcode: stored.Zipcode})
+	}
+
+	return users, nil
+}
+
+func (m *MemoryRepository) Credentials(name string) (User, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id := 1; id <= m.lastUserID; id++ {
+		u, ok := m.users[id]
+		if ok && u.Name == name {
+			return User{ID: u.ID, Name: u.Name, Role: u.Role, Verified: u.Verified}, m.passwords[id], nil
+		}
+	}
+
+	return User{Name: name}, "", sql.ErrNoRows
+}
+
+func (m *MemoryRepository) VerifyEmail(id int, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok || u.Email == "" || u.Email != email {
+		return sql.ErrNoRows
+	}
+
+	u.Verified = true
+	m.users[id] = u
+	return nil
+}
+
+func (m *MemoryRepository) UnverifiedUser(email string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == email && !u.Verified {
+			return User{ID: u.ID, Name: u.Name, Email: u.Email}, nil
+		}
+	}
+
+	return User{Email: email}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) CreateOrder(o *Order) error {
+	if err := o.duplicateLines(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := o.getItemIDs()
+	if err := m.checkItems(ids); err != nil {
+		return err
+	}
+
+	o.StoreNo = m.users[o.UserID].ClosestStore.No
+
+	stored := memoryOrder{userID: o.UserID, taxRate: o.TaxRate, storeNo: o.StoreNo, status: statusDraft, version: 1, createdAt: time.Now().Unix()}
+	for i := range o.Items {
+		line := &o.Items[i]
+		line.UnitPrice = m.items[line.ID].UnitPrice
+		if line.Quantity == 0 {
+			line.Quantity = 1
+		}
+		stored.lines = append(stored.lines, memoryLine{itemID: line.ID, quantity: line.Quantity, unitPrice: line.UnitPrice})
+	}
+
+	if err := m.reserveLines(o.StoreNo, o.Items); err != nil {
+		return err
+	}
+
+	m.lastOrderID++
+	o.ID = m.lastOrderID
+	m.orders[o.ID] = stored
+	m.recordRevision(o.ID, stored.version, o.UserID, revisionCreated, lineChanges(nil, o.lines()))
+	o.Status = statusDraft
+	o.Version = stored.version
+	o.price()
+
+	return nil
+}
+
+func (m *MemoryRepository) GetOrder(o *Order, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.orders[o.ID]
+	if !ok || stored.userID != userID || !stored.deletedAt.IsZero() {
+		return errOrderNotFound
+	}
+
+	o.UserID = userID
+	o.User = m.users[userID].Name
+	o.TaxRate = stored.taxRate
+	o.StoreNo = stored.storeNo
+	o.Status = stored.status
+	o.Version = stored.version
+	o.Transitions = append([]Transition(nil), stored.transitions...)
+	o.Items = m.resolveItems(stored.lines)
+	o.price()
+
+	return nil
+}
+
+func (m *MemoryRepository) GetOrders(userID int, q OrderQuery) (Orders, *OrderCursor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type listed struct {
+		order Order
+		key   int64
+	}
+
+	var matches []listed
+	for id, stored := range m.orders {
+		if stored.userID != userID || !stored.deletedAt.IsZero() || !m.matchesQuery(stored, q) {
+			continue
+		}
+
+		o := Order{ID: id, UserID: userID, User: m.users[userID].Name, TaxRate: stored.taxRate, StoreNo: stored.storeNo, Status: stored.status, Version: stored.version}
+		o.Items = m.resolveItems(stored.lines)
+		o.price()
+
+		key := stored.createdAt
+		if q.Sort == sortTotal || q.Sort == sortTotalDesc {
+			key = int64(o.Total)
+		}
+		matches = append(matches, listed{o, key})
+	}
+
+	ascending := q.Sort == sortOldest || q.Sort == sortTotal
+	before := func(a, b listed) bool {
+		if a.key != b.key {
+			return (a.key < b.key) == ascending
+		}
+		return a.order.ID != b.order.ID && (a.order.ID < b.order.ID) == ascending
+	}
+	sort.Slice(matches, func(x, y int) bool { return before(matches[x], matches[y]) })
+
+	start := q.Offset
+	if q.After != nil {
+		after := listed{Order{ID: q.After.ID}, q.After.Key}
+		start = sort.Search(len(matches), func(i int) bool { return before(after, matches[i]) })
+	}
+	if start > len(matches) {
+		start = len(matches)
+	}
+	matches = matches[start:]
+
+	var next *OrderCursor
+	if len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+		last := matches[q.Limit-1]
+		next = &OrderCursor{Key: last.key, ID: last.order.ID}
+	}
+
+	orders := Orders{}
+	for _, match := range matches {
+		orders = append(orders, match.order)
+	}
+
+	return orders, next, nil
+}
+
+// matchesQuery applies the filters of a listing to an order.
+func (m *MemoryRepository) matchesQuery(stored memoryOrder, q OrderQuery) bool {
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, status := range q.Statuses {
+			found = found || stored.status == status
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !q.From.IsZero() && stored.createdAt < q.From.Unix() {
+		return false
+	}
+
+	if !q.To.IsZero() && stored.createdAt >= q.To.Unix() {
+		return false
+	}
+
+	if q.ItemID != 0 {
+		for _, line := range stored.lines {
+			if line.itemID == q.ItemID {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (m *MemoryRepository) UpdateOrder(o *Order) error {
+	if err := o.duplicateLines(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.orders[o.ID]
+	if !ok || stored.userID != o.UserID || !stored.deletedAt.IsZero() {
+		return errOrderNotFound
+	}
+
+	if o.Version != 0 && o.Version != stored.version {
+		return errStaleOrder
+	}
+
+	o.Status = stored.status
+	if !o.editable() {
+		return errOrderLocked
+	}
+
+	if len(o.Items) == 0 && o.Status != statusDraft {
+		return errEmptyOrder
+	}
+
+	existing := make(map[int]memoryLine)
+	for _, line := range stored.lines {
+		existing[line.itemID] = line
+	}
+
+	var adds []int
+	for _, item := range o.Items {
+		if _, ok := existing[item.ID]; !ok {
+			adds = append(adds, item.ID)
+		}
+	}
+
+	if err := m.checkItems(adds); err != nil {
+		return err
+	}
+
+	desired := o.lines()
+
+	var reserve Items
+	for _, item := range o.Items {
+		if delta := desired[item.ID] - existing[item.ID].quantity; delta > 0 {
+			reserve = append(reserve, Item{ID: item.ID, Quantity: delta})
+		}
+	}
+
+	if err := m.reserveLines(stored.storeNo, reserve); err != nil {
+		return err
+	}
+
+	for id, line := range existing {
+		if delta := line.quantity - desired[id]; delta > 0 {
+			m.releaseStock(stored.storeNo, id, delta, false)
+		}
+	}
+	stored.lines = nil
+	for i := range o.Items {
+		line := &o.Items[i]
+		line.Quantity = desired[line.ID]
+		if e, ok := existing[line.ID]; ok {
+			line.UnitPrice = e.unitPrice
+		} else {
+			line.UnitPrice = m.items[line.ID].UnitPrice
+		}
+		stored.lines = append(stored.lines, memoryLine{itemID: line.ID, quantity: line.Quantity, unitPrice: line.UnitPrice})
+	}
+
+	before := make(map[int]int)
+	for id, line := range existing {
+		before[id] = line.quantity
+	}
+
+	stored.version++
+	m.orders[o.ID] = stored
+	if changes := lineChanges(before, desired); len(changes) > 0 {
+		m.recordRevision(o.ID, stored.version, o.UserID, revisionUpdated, changes)
+	}
+	o.TaxRate = stored.taxRate
+	o.StoreNo = stored.storeNo
+	o.Version = stored.version
+	o.price()
+
+	return nil
+}
+
+func (m *MemoryRepository) DeleteOrder(o *Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.orders[o.ID]
+	if !ok || stored.userID != o.UserID || !stored.deletedAt.IsZero() {
+		return errOrderNotFound
+	}
+
+	if o.Version != 0 && o.Version != stored.version {
+		return errStaleOrder
+	}
+
+	o.Status = stored.status
+	if !o.editable() {
+		return errOrderLocked
+	}
+
+	before := make(map[int]int)
+	for _, line := range stored.lines {
+		m.releaseStock(stored.storeNo, line.itemID, line.quantity, false)
+		before[line.itemID] = line.quantity
+	}
+
+	stored.version++
+	stored.deletedAt = time.Now()
+	m.orders[o.ID] = stored
+	m.recordRevision(o.ID, stored.version, o.UserID, revisionDeleted, lineChanges(before, nil))
+
+	return nil
+}
+
+func (m *MemoryRepository) RestoreOrder(o *Order, since time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.orders[o.ID]
+	if !ok || stored.userID != o.UserID || stored.deletedAt.IsZero() {
+		return errOrderNotFound
+	}
+
+	if stored.deletedAt.Unix() < since.Unix() {
+		return errRestoreExpired
+	}
+
+	var lines Items
+	after := make(map[int]int)
+	for _, line := range stored.lines {
+		lines = append(lines, Item{ID: line.itemID, Quantity: line.quantity})
+		after[line.itemID] = line.quantity
+	}
+
+	if err := m.reserveLines(stored.storeNo, lines); err != nil {
+		return err
+	}
+
+	stored.version++
+	stored.deletedAt = time.Time{}
+	m.orders[o.ID] = stored
+	m.recordRevision(o.ID, stored.version, o.UserID, revisionRestored, lineChanges(nil, after))
+
+	o.StoreNo = stored.storeNo
+	o.Version = stored.version
+	return nil
+}
+
+func (m *MemoryRepository) PurgeOrders(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for id, stored := range m.orders {
+		if !stored.deletedAt.IsZero() && stored.deletedAt.Unix() < before.Unix() {
+			delete(m.orders, id)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (m *MemoryRepository) TransitionOrder(o *Order, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	staff := o.UserID == 0
+
+	stored, ok := m.orders[o.ID]
+	if !ok || (!staff && stored.userID != o.UserID) || !stored.deletedAt.IsZero() {
+		return errOrderNotFound
+	}
+
+	if !canTransition(stored.status, to, staff) {
+		return &invalidTransitionError{From: stored.status, To: to}
+	}
+
+	if to == statusPlaced && len(stored.lines) == 0 {
+		return errEmptyOrder
+	}
+
+	if to == statusCancelled || to == statusCompleted {
+		for _, line := range stored.lines {
+			m.releaseStock(stored.storeNo, line.itemID, line.quantity, to == statusCompleted)
+		}
+	}
+
+	t := Transition{From: stored.status, To: to, At: time.Now().UTC().Truncate(time.Second)}
+	stored.status = to
+	stored.version++
+	stored.transitions = append(stored.transitions, t)
+	m.orders[o.ID] = stored
+
+	o.UserID = stored.userID
+	o.StoreNo = stored.storeNo
+	o.Status = to
+	o.Version = stored.version
+	o.Transitions = append(o.Transitions, t)
+	return nil
+}
+
+// OrderHistory is scoped by the order's owner, also while it is soft deleted.
+// Once it is purged, the owner is the user of its last 'deleted' revision.
+func (m *MemoryRepository) OrderHistory(orderID, userID int) ([]Revision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revisions := m.revisions[orderID]
+
+	// Purged orders were deleted by their owner.
+	owner := 0
+	if stored, ok := m.orders[orderID]; ok {
+		owner = stored.userID
+	} else {
+		for _, rev := range revisions {
+			if rev.Action == revisionDeleted {
+				owner = rev.UserID
+			}
+		}
+	}
+
+	if owner == 0 || (userID != 0 && owner != userID) {
+		return nil, errOrderNotFound
+	}
+
+	history := []Revision{}
+	for _, rev := range revisions {
+		rev.User = m.users[rev.UserID].Name
+		history = append(history, rev)
+	}
+
+	return history, nil
+}
+
+func (m *MemoryRepository) recordRevision(orderID, version, userID int, action string, changes []LineChange) {
+	m.revisions[orderID] = append(m.revisions[orderID], Revision{
+		Version: version,
+		Action:  action,
+		UserID:  userID,
+		At:      time.Now().UTC().Truncate(time.Second),
+		Changes: changes,
+	})
+}
+
+func (m *MemoryRepository) SetStock(storeNo, itemID, onHand int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, storeOK := m.stores[storeNo]
+	_, itemOK := m.items[itemID]
+	if !storeOK || !itemOK {
+		return sql.ErrNoRows
+	}
+
+	key := stockKey{storeNo, itemID}
+	stock := m.inventory[key]
+	if onHand < stock.Reserved {
+		return errStockReserved
+	}
+
+	stock.StoreNo = storeNo
+	stock.ItemID = itemID
+	stock.OnHand = onHand
+	m.inventory[key] = stock
+
+	return nil
+}
+
+func (m *MemoryRepository) GetInventory(storeNo int) ([]Stock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inventory := []Stock{}
+	for key, stock := range m.inventory {
+		if key.storeNo == storeNo {
+			stock.Available = stock.OnHand - stock.Reserved
+			inventory = append(inventory, stock)
+		}
+	}
+	sort.Slice(inventory, func(x, y int) bool { return inventory[x].ItemID < inventory[y].ItemID })
+
+	return inventory, nil
+}
+
+// reserveLines mirrors SQLRepository's reservation, only touching the
+// inventory once every line fits.
+func (m *MemoryRepository) reserveLines(storeNo int, lines Items) error {
+	if storeNo == 0 {
+		return nil
+	}
+
+	var short []Shortage
+	for _, line := range lines {
+		stock := m.inventory[stockKey{storeNo, line.ID}]
+		if available := stock.OnHand - stock.Reserved; available < line.Quantity {
+			short = append(short, Shortage{ItemID: line.ID, Requested: line.Quantity, Available: available})
+		}
+	}
+
+	if len(short) > 0 {
+		return &insufficientStockError{Items: short}
+	}
+
+	for _, line := range lines {
+		key := stockKey{storeNo, line.ID}
+		stock := m.inventory[key]
+		stock.Reserved += line.Quantity
+		m.inventory[key] = stock
+	}
+
+	return nil
+}
+
+func (m *MemoryRepository) releaseStock(storeNo, itemID, quantity int, consume bool) {
+	key := stockKey{storeNo, itemID}
+	stock, ok := m.inventory[key]
+	if !ok {
+		return
+	}
+
+	stock.Reserved -= quantity
+	if consume {
+		stock.OnHand -= quantity
+	}
+	m.inventory[key] = stock
+}
+
+func (m *MemoryRepository) BeginIdempotent(userID int, key, requestHash string) (IdempotentRequest, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := requestKey{userID, key}
+	stored, ok := m.requests[k]
+	if ok && time.Since(stored.CreatedAt) < idempotencyKeyTTL {
+		return stored, false, nil
+	}
+
+	stored = IdempotentRequest{RequestHash: requestHash, CreatedAt: time.Now()}
+	m.requests[k] = stored
+
+	return stored, true, nil
+}
+
+func (m *MemoryRepository) CompleteIdempotent(userID int, key string, code int, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := requestKey{userID, key}
+	if stored, ok := m.requests[k]; ok {
+		stored.StatusCode = code
+		stored.Body = append([]byte(nil), body...)
+		m.requests[k] = stored
+	}
+
+	return nil
+}
+
+func (m *MemoryRepository) AbandonIdempotent(userID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.requests, requestKey{userID, key})
+
+	return nil
+}
+
+func (m *MemoryRepository) CreateSession(userID int, tokenHash string, expiresAt time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastSessionID++
+	m.sessions[m.lastSessionID] = memorySession{userID: userID, tokenHash: tokenHash, expiresAt: expiresAt}
+
+	return m.lastSessionID, nil
+}
+
+func (m *MemoryRepository) RedeemSession(tokenHash string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.tokenHash == tokenHash && !s.revoked && time.Now().Before(s.expiresAt) {
+			s.revoked = true
+			m.sessions[id] = s
+
+			u := m.users[s.userID]
+			return User{ID: u.ID, Name: u.Name, Role: u.Role}, nil
+		}
+	}
+
+	return User{}, errors.New("Refresh token is invalid.")
+}
+
+func (m *MemoryRepository) RevokeSession(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[id]; ok {
+		s.revoked = true
+		m.sessions[id] = s
+	}
+
+	return nil
+}
+
+func (m *MemoryRepository) SessionActive(id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	return ok && !s.revoked && time.Now().Before(s.expiresAt), nil
+}
+
+// resolveItems drops lines whose item is missing from the catalog and orders
+// them by ID, like the joins and ORDER BY on items do for SQLRepository.
+func (m *MemoryRepository) resolveItems(lines []memoryLine) Items {
+	items := Items{}
+	for _, line := range lines {
+		if i, ok := m.items[line.itemID]; ok {
+			items = append(items, Item{ID: i.ID, Name: i.Name, Quantity: line.quantity, UnitPrice: line.unitPrice})
+		}
+	}
+	sort.Slice(items, func(x, y int) bool { return items[x].ID < items[y].ID })
+	return items
+}
+
+func page(ids []int, count, start int) []int {
+	if start >= len(ids) {
+		return nil
+	}
+
+	end := start + count
+	if end > len(ids) {
+		end = len(ids)
+	}
+
+	return ids[start:end]
+}
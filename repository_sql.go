@@ -0,0 +1,1490 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// SQLRepository implements the repositories on top of database/sql, against
+// the schema built by the migrations. Queries use $N placeholders, which both
+// SQLite and PostgreSQL accept.
+type SQLRepository struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func NewSQLRepository(db *sql.DB, dialect Dialect) *SQLRepository {
+	return &SQLRepository{db: db, dialect: dialect}
+}
+
+// Credentials returns the user and their password hash, or sql.ErrNoRows.
+func (r *SQLRepository) Credentials(name string) (User, string, error) {
+	u := User{Name: name}
+
+	var hashedPassword string
+	err := r.db.QueryRow("SELECT id, password, role, verified FROM users WHERE name=$1", name).Scan(&u.ID, &hashedPassword, &u.Role, &u.Verified)
+	return u, hashedPassword, err
+}
+
+func (r *SQLRepository) VerifyEmail(id int, email string) error {
+	result, err := r.db.Exec(`UPDATE users SET verified=1 WHERE id=$1 AND email=$2`, id, email)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *SQLRepository) UnverifiedUser(email string) (User, error) {
+	u := User{Email: email}
+	err := r.db.QueryRow(`SELECT id, name FROM users WHERE email=$1 AND verified=0`, email).Scan(&u.ID, &u.Name)
+	return u, err
+}
+
+// upsertStore records the latest details the locator returned for a store.
+func upsertStore(tx *sql.Tx, s *Store) error {
+	var lon, lat sql.NullFloat64
+	if len(s.Coordinates) == 2 {
+		lon = sql.NullFloat64{Float64: s.Coordinates[0], Valid: true}
+		lat = sql.NullFloat64{Float64: s.Coordinates[1], Valid: true}
+	}
+
+	statement := `INSERT INTO stores(no, name, street_address, city, state_prov_code, zip, country, phone_number, sunday_open, timezone, longitude, latitude)
+  VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+  ON CONFLICT(no) DO UPDATE SET name=excluded.name, street_address=excluded.street_address, city=excluded.city,
+  state_prov_code=excluded.state_prov_code, zip=excluded.zip, country=excluded.country, phone_number=excluded.phone_number,
+  sunday_open=excluded.sunday_open, timezone=excluded.timezone, longitude=excluded.longitude, latitude=excluded.latitude`
+
+	_, err := tx.Exec(statement, s.No, s.Name, s.StreetAddress, s.City, s.StateProvCode, s.Zip, s.Country, s.PhoneNumber, s.SundayOpen, s.Timezone, lon, lat)
+	if err != nil {
+		log.Error("upserting to stores failed.")
+	}
+	return err
+}
+
+// CreateUser stores the user linked to their closest store, upserting the
+// store in the same transaction. New users are pending until they verify
+// their email address.
+func (r *SQLRepository) CreateUser(u *User) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return err
+	}
+	defer tx.Rollback()
+
+	// Checking first saves upserting the store, but only the unique index
+	// settles concurrent signups with the same address.
+	if u.Email != "" {
+		var count int
+		if err = tx.QueryRow(`SELECT COUNT(*) FROM users WHERE email=$1`, u.Email).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return errDuplicateEmail
+		}
+	}
+
+	if err = upsertStore(tx, &u.ClosestStore); err != nil {
+		return err
+	}
+
+	statement := "INSERT INTO users(name,email,password,role,zip,store_no,store_distance,verified) VALUES($1, $2, $3, $4, $5, $6, $7, 0)"
+	id, err := r.dialect.insert(tx, statement, u.Name, nullString(u.Email), u.Password, u.Role, u.Zipcode, u.ClosestStore.No, u.ClosestStore.Distance)
+	if isUniqueViolation(err) {
+		return errDuplicateEmail
+	}
+	if err != nil {
+		log.Error("inserting to users failed.")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing user failed.")
+		return err
+	}
+
+	u.ID = id
+	u.Password = ""
+	u.Verified = false
+	return nil
+}
+
+func (r *SQLRepository) GetUser(u *User) error {
+	statement := `SELECT users.name, COALESCE(users.email, ''), users.role, users.store_lat, users.store_lon, COALESCE(users.store_distance, 0),
+  stores.no, stores.name, stores.street_address, stores.city, stores.state_prov_code, stores.zip, stores.country,
+  stores.phone_number, stores.sunday_open, stores.timezone, stores.longitude, stores.latitude
+  FROM users LEFT JOIN stores ON users.store_no=stores.no WHERE users.id=$1`
+
+	var legacyLat, legacyLon, lon, lat sql.NullFloat64
+	var no sql.NullInt64
+	var name, street, city, state, zip, country, phone, timezone sql.NullString
+	var sundayOpen sql.NullBool
+
+	s := &u.ClosestStore
+	err := r.db.QueryRow(statement, u.ID).Scan(&u.Name, &u.Email, &u.Role, &legacyLat, &legacyLon, &s.Distance,
+		&no, &name, &street, &city, &state, &zip, &country, &phone, &sundayOpen, &timezone, &lon, &lat)
+	if err != nil {
+		return err
+	}
+
+	if !no.Valid {
+		// Users created before stores were persisted only kept the coordinates.
+		if legacyLat.Valid && legacyLon.Valid {
+			s.Coordinates = []float64{legacyLat.Float64, legacyLon.Float64}
+		}
+		return nil
+	}
+
+	s.No = int(no.Int64)
+	s.Name = name.String
+	s.StreetAddress = street.String
+	s.City = city.String
+	s.StateProvCode = state.String
+	s.Zip = zip.String
+	s.Country = country.String
+	s.PhoneNumber = phone.String
+	s.SundayOpen = sundayOpen.Bool
+	s.Timezone = timezone.String
+	if lon.Valid && lat.Valid {
+		s.Coordinates = []float64{lon.Float64, lat.Float64}
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) GetUsers(count, start int) (Users, error) {
+	statement := `SELECT id, name, role, COALESCE(zip, 0) FROM users ORDER BY id LIMIT $1 OFFSET $2`
+
+	rows, err := r.db.Query(statement, count, start)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := Users{}
+	for rows.Next() {
+		u := User{}
+		if err = rows.Scan(&u.ID, &u.Name, &u.Role, &u.Zipcode); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// CreateOrder inserts the order and its items in a single transaction, so a
+// failure on any item leaves no partial order behind.
+func (r *SQLRepository) CreateOrder(o *Order) error {
+	if err := o.duplicateLines(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return err
+	}
+	defer tx.Rollback()
+
+	prices, err := catalogPrices(tx, o.getItemIDs())
+	if err != nil {
+		return err
+	}
+
+	var storeNo sql.NullInt64
+	err = tx.QueryRow(`SELECT store_no FROM users WHERE id=$1`, o.UserID).Scan(&storeNo)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+		return err
+	}
+	o.StoreNo = int(storeNo.Int64)
+
+	for i := range o.Items {
+		line := &o.Items[i]
+		line.UnitPrice = prices[line.ID]
+		if line.Quantity == 0 {
+			line.Quantity = 1
+		}
+	}
+
+	if err = reserveLines(tx, o.StoreNo, o.Items); err != nil {
+		return err
+	}
+
+	statement := `INSERT INTO orders(user_id, tax_rate, status, store_no, created_at) VALUES($1, $2, $3, $4, $5)`
+	id, err := r.dialect.insert(tx, statement, o.UserID, o.TaxRate, statusDraft, storeNo, time.Now().Unix())
+	if err != nil {
+		log.Error("inserting to orders failed.")
+		return err
+	}
+
+	statement = `INSERT INTO order_items(order_id, item_id, quantity, unit_price) VALUES($1, $2, $3, $4)`
+	for _, line := range o.Items {
+		_, err = tx.Exec(statement, id, line.ID, line.Quantity, line.UnitPrice)
+		if err != nil {
+			log.Error("inserting to order_items failed.")
+			return err
+		}
+	}
+
+	if err = recordRevision(tx, id, 1, o.UserID, revisionCreated, lineChanges(nil, o.lines())); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing order failed.")
+		return err
+	}
+
+	o.ID = id
+	o.Status = statusDraft
+	o.Version = 1
+	o.price()
+	return nil
+}
+
+func (r *SQLRepository) GetOrder(o *Order, userID int) error {
+
+	// Draft orders can be empty, which leaves the item columns NULL.
+	statement := `SELECT users.name, orders.tax_rate, orders.status, COALESCE(orders.store_no, 0), orders.version, order_items.item_id, items.name, order_items.quantity, order_items.unit_price FROM orders
+  INNER JOIN users ON orders.user_id=users.id
+  LEFT JOIN order_items ON order_items.order_id=orders.id
+  LEFT JOIN items ON order_items.item_id=items.id
+  WHERE orders.id=$1 AND users.id=$2 AND orders.deleted_at IS NULL ORDER BY order_items.item_id
+  `
+
+	rows, err := r.db.Query(statement, o.ID, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer rows.Close()
+
+	o.UserID = userID
+	o.Items = Items{}
+	found := false
+
+	for rows.Next() {
+		var id, quantity, unitPrice sql.NullInt64
+		var name sql.NullString
+		err = rows.Scan(&o.User, &o.TaxRate, &o.Status, &o.StoreNo, &o.Version, &id, &name, &quantity, &unitPrice)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		found = true
+
+		if id.Valid {
+			o.Items = append(o.Items, Item{ID: int(id.Int64), Name: name.String, Quantity: int(quantity.Int64), UnitPrice: int(unitPrice.Int64)})
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if !found {
+		log.Error(errOrderNotFound)
+		return errOrderNotFound
+	}
+
+	o.Transitions, err = r.orderTransitions(o.ID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	o.price()
+	return nil
+}
+
+func (r *SQLRepository) orderTransitions(orderID int) ([]Transition, error) {
+	statement := `SELECT from_status, to_status, created_at FROM order_transitions WHERE order_id=$1 ORDER BY id`
+
+	rows, err := r.db.Query(statement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transitions []Transition
+	for rows.Next() {
+		t := Transition{}
+		var at int64
+		if err = rows.Scan(&t.From, &t.To, &at); err != nil {
+			return nil, err
+		}
+		t.At = time.Unix(at, 0).UTC()
+		transitions = append(transitions, t)
+	}
+
+	return transitions, rows.Err()
+}
+
+// orderTotalSQL computes the total of an order like Order.price does, so
+// orders can be sorted by it.
+const orderTotalSQL = `(SELECT COALESCE(SUM(quantity*unit_price), 0) + (COALESCE(SUM(quantity*unit_price), 0)*orders.tax_rate+5000)/10000
+  FROM order_items WHERE order_items.order_id=orders.id)`
+
+// GetOrders reads a page of orders and then the lines of all of them, so a
+// page always takes two queries however many orders it has. Past the last
+// page it returns no orders rather than an error. Pages continue
+// from a cursor on the sort key and id rather than an offset, so orders
+// created meanwhile do not shift them.
+func (r *SQLRepository) GetOrders(userID int, q OrderQuery) (Orders, *OrderCursor, error) {
+	args := []interface{}{userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"orders.user_id=$1", "orders.deleted_at IS NULL"}
+
+	if len(q.Statuses) > 0 {
+		var statuses []string
+		for _, status := range q.Statuses {
+			statuses = append(statuses, arg(status))
+		}
+		where = append(where, "orders.status IN ("+strings.Join(statuses, ", ")+")")
+	}
+
+	if !q.From.IsZero() {
+		where = append(where, "orders.created_at>="+arg(q.From.Unix()))
+	}
+
+	if !q.To.IsZero() {
+		where = append(where, "orders.created_at<"+arg(q.To.Unix()))
+	}
+
+	if q.ItemID != 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM order_items WHERE order_items.order_id=orders.id AND order_items.item_id="+arg(q.ItemID)+")")
+	}
+
+	key := "orders.created_at"
+	if q.Sort == sortTotal || q.Sort == sortTotalDesc {
+		key = orderTotalSQL
+	}
+
+	direction, compare := "DESC", "<"
+	if q.Sort == sortOldest || q.Sort == sortTotal {
+		direction, compare = "ASC", ">"
+	}
+
+	if q.After != nil {
+		k, id := arg(q.After.Key), arg(q.After.ID)
+		where = append(where, "("+key+compare+k+" OR ("+key+"="+k+" AND orders.id"+compare+id+"))")
+	}
+
+	statement := `SELECT orders.id, users.name, orders.tax_rate, orders.status, COALESCE(orders.store_no, 0), orders.version, ` + key + ` FROM orders
+  INNER JOIN users ON orders.user_id=users.id
+  WHERE ` + strings.Join(where, " AND ") + `
+  ORDER BY ` + key + ` ` + direction + `, orders.id ` + direction + ` LIMIT ` + arg(q.Limit+1)
+
+	if q.After == nil && q.Offset > 0 {
+		statement += ` OFFSET ` + arg(q.Offset)
+	}
+
+	rows, err := r.db.Query(statement, args...)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+
+	var orders Orders
+	var keys []int64
+	for rows.Next() {
+		o := Order{UserID: userID}
+		var k int64
+		if err = rows.Scan(&o.ID, &o.User, &o.TaxRate, &o.Status, &o.StoreNo, &o.Version, &k); err != nil {
+			rows.Close()
+			log.Error(err)
+			return nil, nil, err
+		}
+		orders = append(orders, o)
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+
+	if len(orders) == 0 {
+		return Orders{}, nil, nil
+	}
+
+	// One more order than asked for was read to tell if there is a next page.
+	var next *OrderCursor
+	if len(orders) > q.Limit {
+		orders = orders[:q.Limit]
+		next = &OrderCursor{Key: keys[q.Limit-1], ID: orders[q.Limit-1].ID}
+	}
+
+	placeholders := make([]string, len(orders))
+	args = make([]interface{}, len(orders))
+	index := make(map[int]int)
+	for i, o := range orders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = o.ID
+		index[o.ID] = i
+		orders[i].Items = Items{}
+	}
+
+	statement = `SELECT order_items.order_id, order_items.item_id, items.name, order_items.quantity, order_items.unit_price FROM order_items
+  INNER JOIN items ON order_items.item_id=items.id
+  WHERE order_items.order_id IN (` + strings.Join(placeholders, ", ") + `) ORDER BY order_items.order_id, order_items.item_id`
+
+	rows, err = r.db.Query(statement, args...)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		i := Item{}
+		if err = rows.Scan(&orderID, &i.ID, &i.Name, &i.Quantity, &i.UnitPrice); err != nil {
+			log.Error(err)
+			return nil, nil, err
+		}
+
+		o := &orders[index[orderID]]
+		o.Items = append(o.Items, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+
+	for i := range orders {
+		orders[i].price()
+	}
+
+	return orders, next, nil
+}
+
+// UpdateOrder diffs the desired lines against the stored ones by quantity and
+// applies the adds, quantity changes and deletes in a single transaction,
+// rolling back if the result does not match what was asked for. Added lines
+// capture the current catalog price, kept lines keep the price they had.
+// Nothing changes unless the order is still at o.Version.
+func (r *SQLRepository) UpdateOrder(o *Order) error {
+	// Lines are diffed by item, so every item must have a single line.
+	if err := o.duplicateLines(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockOrder(tx, o); err != nil {
+		if err == sql.ErrNoRows {
+			err = errOrderNotFound
+		}
+		log.Error(err)
+		return err
+	}
+
+	statement := `SELECT tax_rate, status, COALESCE(store_no, 0) FROM orders WHERE id=$1`
+	if err = tx.QueryRow(statement, o.ID).Scan(&o.TaxRate, &o.Status, &o.StoreNo); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	statement = `SELECT item_id, quantity, unit_price FROM order_items WHERE order_id=$1 ORDER BY item_id`
+	rows, err := tx.Query(statement, o.ID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	existing := make(map[int]Item)
+	var existingIDs []int
+
+	for rows.Next() {
+		e := Item{}
+		err = rows.Scan(&e.ID, &e.Quantity, &e.UnitPrice)
+		if err != nil {
+			log.Error(err)
+			rows.Close()
+			return err
+		}
+
+		existing[e.ID] = e
+		existingIDs = append(existingIDs, e.ID)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if !o.editable() {
+		log.Error(errOrderLocked)
+		return errOrderLocked
+	}
+
+	if len(o.Items) == 0 && o.Status != statusDraft {
+		log.Error(errEmptyOrder)
+		return errEmptyOrder
+	}
+
+	desired := o.lines()
+
+	var adds []int
+	for _, item := range o.Items {
+		if _, ok := existing[item.ID]; !ok {
+			adds = append(adds, item.ID)
+		}
+	}
+
+	prices, err := catalogPrices(tx, adds)
+	if err != nil {
+		return err
+	}
+
+	// Reserve what the order grows by and release what it shrinks by.
+	var reserve Items
+	for _, item := range o.Items {
+		if delta := desired[item.ID] - existing[item.ID].Quantity; delta > 0 {
+			reserve = append(reserve, Item{ID: item.ID, Quantity: delta})
+		}
+	}
+
+	if err = reserveLines(tx, o.StoreNo, reserve); err != nil {
+		return err
+	}
+
+	for _, id := range existingIDs {
+		if delta := existing[id].Quantity - desired[id]; delta > 0 {
+			if err = releaseStock(tx, o.StoreNo, id, delta, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	statement = `INSERT INTO order_items(order_id, item_id, quantity, unit_price) VALUES($1, $2, $3, $4)`
+	for _, addID := range adds {
+		_, err = tx.Exec(statement, o.ID, addID, desired[addID], prices[addID])
+		if err != nil {
+			log.Error("inserting to order_items failed.")
+			return err
+		}
+	}
+
+	statement = `UPDATE order_items SET quantity=$1 WHERE order_id=$2 AND item_id=$3`
+	for _, id := range existingIDs {
+		quantity, ok := desired[id]
+		if !ok || quantity == existing[id].Quantity {
+			continue
+		}
+
+		_, err = tx.Exec(statement, quantity, o.ID, id)
+		if err != nil {
+			log.Error("updating order_items failed.")
+			return err
+		}
+	}
+
+	statement = `DELETE FROM order_items WHERE order_id=$1 AND item_id=$2`
+	for _, id := range existingIDs {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+
+		_, err = tx.Exec(statement, o.ID, id)
+		if err != nil {
+			log.Error("deleting from order_items failed.")
+			return err
+		}
+	}
+
+	// Verify the results
+	statement = `SELECT COUNT(item_id) FROM order_items WHERE order_id=$1`
+
+	var count int
+	err = tx.QueryRow(statement, o.ID).Scan(&count)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if count != len(o.Items) {
+		e := errors.New("Incorrect updates on order_items.")
+		log.Info(e)
+		return e
+	}
+
+	before := make(map[int]int)
+	for id, e := range existing {
+		before[id] = e.Quantity
+	}
+
+	if changes := lineChanges(before, desired); len(changes) > 0 {
+		if err = recordRevision(tx, o.ID, o.Version, o.UserID, revisionUpdated, changes); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing order update failed.")
+		return err
+	}
+
+	for i := range o.Items {
+		line := &o.Items[i]
+		line.Quantity = desired[line.ID]
+		if e, ok := existing[line.ID]; ok {
+			line.UnitPrice = e.UnitPrice
+		} else {
+			line.UnitPrice = prices[line.ID]
+		}
+	}
+	o.price()
+
+	return nil
+}
+
+// DeleteOrder gives back the order's stock and marks it deleted, keeping its
+// items so it can be restored until it is purged.
+func (r *SQLRepository) DeleteOrder(o *Order) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockOrder(tx, o); err != nil {
+		if err == sql.ErrNoRows {
+			err = errOrderNotFound
+		}
+		log.Error(err)
+		return err
+	}
+
+	statement := `SELECT status, COALESCE(store_no, 0) FROM orders WHERE user_id=$1 AND id=$2`
+	err = tx.QueryRow(statement, o.UserID, o.ID).Scan(&o.Status, &o.StoreNo)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if !o.editable() {
+		log.Error(errOrderLocked)
+		return errOrderLocked
+	}
+
+	lines, err := orderLines(tx, o.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = releaseLines(tx, o.StoreNo, lines, false); err != nil {
+		return err
+	}
+
+	deleted := Order{Items: lines}
+	if err = recordRevision(tx, o.ID, o.Version, o.UserID, revisionDeleted, lineChanges(deleted.lines(), nil)); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE orders SET deleted_at=$1 WHERE id=$2`, time.Now().Unix(), o.ID)
+	if err != nil {
+		log.Error("deleting order failed: ", err)
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing order deletion failed.")
+		return err
+	}
+
+	return nil
+}
+
+// RestoreOrder clears deleted_at if it has not changed since it was read, so
+// concurrent restores can not both reserve the stock.
+func (r *SQLRepository) RestoreOrder(o *Order, since time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return err
+	}
+	defer tx.Rollback()
+
+	var deletedAt sql.NullInt64
+	statement := `SELECT deleted_at, COALESCE(store_no, 0) FROM orders WHERE id=$1 AND user_id=$2`
+	err = tx.QueryRow(statement, o.ID, o.UserID).Scan(&deletedAt, &o.StoreNo)
+	if err == sql.ErrNoRows || (err == nil && !deletedAt.Valid) {
+		return errOrderNotFound
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if deletedAt.Int64 < since.Unix() {
+		return errRestoreExpired
+	}
+
+	lines, err := orderLines(tx, o.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = reserveLines(tx, o.StoreNo, lines); err != nil {
+		return err
+	}
+
+	statement = `UPDATE orders SET deleted_at=NULL, version=version+1 WHERE id=$1 AND deleted_at=$2`
+	result, err := tx.Exec(statement, o.ID, deletedAt.Int64)
+	if err != nil {
+		log.Error("restoring order failed.")
+		return err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if number == 0 {
+		return errOrderNotFound
+	}
+
+	if err = tx.QueryRow(`SELECT version FROM orders WHERE id=$1`, o.ID).Scan(&o.Version); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	restored := Order{Items: lines}
+	if err = recordRevision(tx, o.ID, o.Version, o.UserID, revisionRestored, lineChanges(nil, restored.lines())); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing order restore failed.")
+		return err
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) PurgeOrders(before time.Time) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	statement := `DELETE FROM order_transitions WHERE order_id IN (SELECT id FROM orders WHERE deleted_at<$1)`
+	_, err = tx.Exec(statement, before.Unix())
+	if err != nil {
+		log.Error("deleting from order_transitions failed: ", err)
+		return 0, err
+	}
+
+	statement = `DELETE FROM order_items WHERE order_id IN (SELECT id FROM orders WHERE deleted_at<$1)`
+	_, err = tx.Exec(statement, before.Unix())
+	if err != nil {
+		log.Error("deleting from order_items failed: ", err)
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM orders WHERE deleted_at<$1`, before.Unix())
+	if err != nil {
+		log.Error("deleting from orders failed: ", err)
+		return 0, err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing order purge failed.")
+		return 0, err
+	}
+
+	return int(number), nil
+}
+
+// TransitionOrder moves the order to a new status if the current one allows
+// it. The status is only updated if it has not changed since it was read, so
+// concurrent transitions can not both succeed.
+func (r *SQLRepository) TransitionOrder(o *Order, to string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Error("starting transaction failed.")
+		return err
+	}
+	defer tx.Rollback()
+
+	staff := o.UserID == 0
+
+	var from string
+	var userID, storeNo int
+	statement := `SELECT status, user_id, COALESCE(store_no, 0) FROM orders WHERE id=$1 AND (user_id=$2 OR $2=0) AND deleted_at IS NULL`
+	err = tx.QueryRow(statement, o.ID, o.UserID).Scan(&from, &userID, &storeNo)
+	if err == sql.ErrNoRows {
+		log.Error(errOrderNotFound)
+		return errOrderNotFound
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if !canTransition(from, to, staff) {
+		return &invalidTransitionError{From: from, To: to}
+	}
+
+	if to == statusPlaced {
+		var count int
+		if err = tx.QueryRow(`SELECT COUNT(*) FROM order_items WHERE order_id=$1`, o.ID).Scan(&count); err != nil {
+			log.Error(err)
+			return err
+		}
+		if count == 0 {
+			return errEmptyOrder
+		}
+	}
+
+	result, err := tx.Exec(`UPDATE orders SET status=$1, version=version+1 WHERE id=$2 AND status=$3`, to, o.ID, from)
+	if err != nil {
+		log.Error("updating order status failed.")
+		return err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if number == 0 {
+		return &invalidTransitionError{From: from, To: to}
+	}
+
+	// Cancelled orders give their stock back, completed ones take it away.
+	if to == statusCancelled || to == statusCompleted {
+		if err = releaseOrder(tx, o.ID, storeNo, to == statusCompleted); err != nil {
+			return err
+		}
+	}
+
+	var version int
+	if err = tx.QueryRow(`SELECT version FROM orders WHERE id=$1`, o.ID).Scan(&version); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	at := time.Now().UTC().Truncate(time.Second)
+	statement = `INSERT INTO order_transitions(order_id, from_status, to_status, created_at) VALUES($1, $2, $3, $4)`
+	_, err = tx.Exec(statement, o.ID, from, to, at.Unix())
+	if err != nil {
+		log.Error("inserting to order_transitions failed.")
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("committing order transition failed.")
+		return err
+	}
+
+	o.UserID = userID
+	o.StoreNo = storeNo
+	o.Status = to
+	o.Version = version
+	o.Transitions = append(o.Transitions, Transition{From: from, To: to, At: at})
+	return nil
+}
+
+// lockOrder bumps the version of the order if it is still o.Version, which
+// also locks its row until the transaction ends, so concurrent writers of the
+// same version can not both succeed. A zero o.Version skips the check. It
+// returns sql.ErrNoRows when the user has no such order and errStaleOrder when
+// the version has moved on.
+func lockOrder(tx *sql.Tx, o *Order) error {
+	statement := `UPDATE orders SET version=version+1 WHERE id=$1 AND user_id=$2 AND (version=$3 OR $3=0) AND deleted_at IS NULL`
+	result, err := tx.Exec(statement, o.ID, o.UserID, o.Version)
+	if err != nil {
+		return err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow(`SELECT version FROM orders WHERE id=$1 AND user_id=$2 AND deleted_at IS NULL`, o.ID, o.UserID).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if number == 0 {
+		return errStaleOrder
+	}
+
+	o.Version = version
+	return nil
+}
+
+// catalogPrices returns the current unit price of each item, or an
+// invalidItemsError for the ids that are not live catalog items.
+func catalogPrices(tx *sql.Tx, ids []int) (map[int]int, error) {
+	statement := `SELECT unit_price, archived FROM items WHERE id=$1`
+
+	prices := make(map[int]int)
+	var invalid []int
+	for _, id := range ids {
+		var price int
+		var archived bool
+		err := tx.QueryRow(statement, id).Scan(&price, &archived)
+		if err == sql.ErrNoRows || (err == nil && archived) {
+			invalid = append(invalid, id)
+			continue
+		}
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		prices[id] = price
+	}
+
+	if len(invalid) > 0 {
+		return nil, &invalidItemsError{IDs: invalid}
+	}
+
+	return prices, nil
+}
+
+// reserveLines reserves the quantity of each line at the store, returning an
+// insufficientStockError listing every line that could not be reserved. A
+// zero store means the order is not tracked against any inventory.
+func reserveLines(tx *sql.Tx, storeNo int, lines Items) error {
+	if storeNo == 0 {
+		return nil
+	}
+
+	var short []Shortage
+	for _, line := range lines {
+		available, ok, err := reserveStock(tx, storeNo, line.ID, line.Quantity)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+
+		if !ok {
+			short = append(short, Shortage{ItemID: line.ID, Requested: line.Quantity, Available: available})
+		}
+	}
+
+	if len(short) > 0 {
+		return &insufficientStockError{Items: short}
+	}
+
+	return nil
+}
+
+// reserveStock only reserves while enough stock is unreserved, in a single
+// conditional update, so concurrent orders can not oversell. When it fails it
+// returns what is available instead.
+func reserveStock(tx *sql.Tx, storeNo, itemID, quantity int) (int, bool, error) {
+	statement := `UPDATE inventory SET reserved=reserved+$1 WHERE store_no=$2 AND item_id=$3 AND on_hand-reserved>=$1`
+	result, err := tx.Exec(statement, quantity, storeNo, itemID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if number == 1 {
+		return 0, true, nil
+	}
+
+	var available int
+	err = tx.QueryRow(`SELECT on_hand-reserved FROM inventory WHERE store_no=$1 AND item_id=$2`, storeNo, itemID).Scan(&available)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return available, false, err
+}
+
+// releaseStock gives back a reservation, or with consume takes the reserved
+// units out of the stock on hand as they leave the store.
+func releaseStock(tx *sql.Tx, storeNo, itemID, quantity int, consume bool) error {
+	if storeNo == 0 {
+		return nil
+	}
+
+	statement := `UPDATE inventory SET reserved=reserved-$1 WHERE store_no=$2 AND item_id=$3`
+	if consume {
+		statement = `UPDATE inventory SET on_hand=on_hand-$1, reserved=reserved-$1 WHERE store_no=$2 AND item_id=$3`
+	}
+
+	_, err := tx.Exec(statement, quantity, storeNo, itemID)
+	if err != nil {
+		log.Error("releasing inventory failed.")
+	}
+	return err
+}
+
+// releaseOrder releases the stock reserved by every line of the order.
+func releaseOrder(tx *sql.Tx, orderID, storeNo int, consume bool) error {
+	if storeNo == 0 {
+		return nil
+	}
+
+	lines, err := orderLines(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	return releaseLines(tx, storeNo, lines, consume)
+}
+
+func releaseLines(tx *sql.Tx, storeNo int, lines Items, consume bool) error {
+	for _, line := range lines {
+		if err := releaseStock(tx, storeNo, line.ID, line.Quantity, consume); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// orderLines reads the item ids and quantities of the order.
+func orderLines(tx *sql.Tx, orderID int) (Items, error) {
+	rows, err := tx.Query(`SELECT item_id, quantity FROM order_items WHERE order_id=$1 ORDER BY item_id`, orderID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines Items
+	for rows.Next() {
+		line := Item{}
+		if err = rows.Scan(&line.ID, &line.Quantity); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// recordRevision appends a revision to the history of the order.
+func recordRevision(tx *sql.Tx, orderID, version, userID int, action string, changes []LineChange) error {
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	statement := `INSERT INTO order_revisions(order_id, version, action, user_id, changes, created_at) VALUES($1, $2, $3, $4, $5, $6)`
+	_, err = tx.Exec(statement, orderID, version, action, userID, string(encoded), time.Now().Unix())
+	if err != nil {
+		log.Error("inserting to order_revisions failed.")
+	}
+	return err
+}
+
+// OrderHistory is scoped by the order's owner, also while it is soft deleted.
+// Once it is purged, the owner is the user of its last 'deleted' revision.
+func (r *SQLRepository) OrderHistory(orderID, userID int) ([]Revision, error) {
+	// The owner comes from the order, which is kept while it is soft deleted.
+	// Only owners delete orders, so that revision tells whose a purged one was.
+	var owner int
+	err := r.db.QueryRow(`SELECT user_id FROM orders WHERE id=$1`, orderID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		statement := `SELECT user_id FROM order_revisions WHERE order_id=$1 AND action=$2 ORDER BY id DESC LIMIT 1`
+		err = r.db.QueryRow(statement, orderID, revisionDeleted).Scan(&owner)
+	}
+	if err == sql.ErrNoRows || (err == nil && userID != 0 && owner != userID) {
+		return nil, errOrderNotFound
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	statement := `SELECT order_revisions.version, order_revisions.action, order_revisions.user_id, users.name, order_revisions.changes, order_revisions.created_at
+  FROM order_revisions
+  INNER JOIN users ON order_revisions.user_id=users.id
+  WHERE order_revisions.order_id=$1
+  ORDER BY order_revisions.id`
+
+	rows, err := r.db.Query(statement, orderID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []Revision{}
+	for rows.Next() {
+		rev := Revision{}
+		var changes string
+		var at int64
+		if err = rows.Scan(&rev.Version, &rev.Action, &rev.UserID, &rev.User, &changes, &at); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(changes), &rev.Changes); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		rev.At = time.Unix(at, 0).UTC()
+		history = append(history, rev)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Orders from before revisions were recorded have no history yet.
+	return history, nil
+}
+
+// SetStock upserts the units on hand, refusing to go below what is reserved.
+func (r *SQLRepository) SetStock(storeNo, itemID, onHand int) error {
+	var count int
+	statement := `SELECT (SELECT COUNT(*) FROM stores WHERE no=$1) + (SELECT COUNT(*) FROM items WHERE id=$2)`
+	if err := r.db.QueryRow(statement, storeNo, itemID).Scan(&count); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if count != 2 {
+		return sql.ErrNoRows
+	}
+
+	statement = `INSERT INTO inventory(store_no, item_id, on_hand) VALUES($1, $2, $3)
+  ON CONFLICT(store_no, item_id) DO UPDATE SET on_hand=excluded.on_hand WHERE inventory.reserved<=excluded.on_hand`
+	result, err := r.db.Exec(statement, storeNo, itemID, onHand)
+	if err != nil {
+		log.Error("upserting to inventory failed.")
+		return err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if number == 0 {
+		return errStockReserved
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) GetInventory(storeNo int) ([]Stock, error) {
+	statement := `SELECT item_id, on_hand, reserved FROM inventory WHERE store_no=$1 ORDER BY item_id`
+
+	rows, err := r.db.Query(statement, storeNo)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	inventory := []Stock{}
+	for rows.Next() {
+		s := Stock{StoreNo: storeNo}
+		if err = rows.Scan(&s.ItemID, &s.OnHand, &s.Reserved); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		s.Available = s.OnHand - s.Reserved
+		inventory = append(inventory, s)
+	}
+
+	return inventory, rows.Err()
+}
+
+func (r *SQLRepository) skuTaken(sku string, id int) (bool, error) {
+	if sku == "" {
+		return false, nil
+	}
+
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM items WHERE sku=$1 AND id<>$2`, sku, id).Scan(&count)
+	return count > 0, err
+}
+
+func (r *SQLRepository) CreateItem(i *Item) error {
+	taken, err := r.skuTaken(i.SKU, 0)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errDuplicateSKU
+	}
+
+	statement := `INSERT INTO items(name, sku, description, unit_price, category) VALUES($1, $2, $3, $4, $5)`
+	id, err := r.dialect.insert(r.db, statement, i.Name, nullString(i.SKU), i.Description, i.UnitPrice, i.Category)
+	if err != nil {
+		log.Error("inserting to items failed.")
+		return err
+	}
+
+	i.ID = id
+	i.Archived = false
+	return nil
+}
+
+func (r *SQLRepository) GetItem(i *Item) error {
+	statement := `SELECT name, COALESCE(sku, ''), COALESCE(description, ''), unit_price, COALESCE(category, ''), archived
+  FROM items WHERE id=$1`
+	return r.db.QueryRow(statement, i.ID).Scan(&i.Name, &i.SKU, &i.Description, &i.UnitPrice, &i.Category, &i.Archived)
+}
+
+// GetItems lists the catalog by id, including archived items only when asked.
+func (r *SQLRepository) GetItems(count, start int, archived bool) (Items, error) {
+	statement := `SELECT id, name, COALESCE(sku, ''), COALESCE(description, ''), unit_price, COALESCE(category, ''), archived
+  FROM items WHERE archived=0 OR $1=1 ORDER BY id LIMIT $2 OFFSET $3`
+
+	includeArchived := 0
+	if archived {
+		includeArchived = 1
+	}
+
+	rows, err := r.db.Query(statement, includeArchived, count, start)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := Items{}
+	for rows.Next() {
+		i := Item{}
+		if err = rows.Scan(&i.ID, &i.Name, &i.SKU, &i.Description, &i.UnitPrice, &i.Category, &i.Archived); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		items = append(items, i)
+	}
+
+	return items, rows.Err()
+}
+
+func (r *SQLRepository) UpdateItem(i *Item) error {
+	taken, err := r.skuTaken(i.SKU, i.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errDuplicateSKU
+	}
+
+	statement := `UPDATE items SET name=$1, sku=$2, description=$3, unit_price=$4, category=$5 WHERE id=$6`
+	result, err := r.db.Exec(statement, i.Name, nullString(i.SKU), i.Description, i.UnitPrice, i.Category, i.ID)
+	if err != nil {
+		log.Error("updating items failed.")
+		return err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if number == 0 {
+		return sql.ErrNoRows
+	}
+
+	return r.GetItem(i)
+}
+
+func (r *SQLRepository) ArchiveItem(id int) error {
+	result, err := r.db.Exec(`UPDATE items SET archived=1 WHERE id=$1`, id)
+	if err != nil {
+		log.Error("archiving item failed.")
+		return err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if number == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// nullString stores empty strings as NULL, so optional unique columns like
+// items.sku do not collide on "".
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// BeginIdempotent claims the key with an insert that does nothing if the key
+// exists, so concurrent retries can not both claim it.
+func (r *SQLRepository) BeginIdempotent(userID int, key, requestHash string) (IdempotentRequest, bool, error) {
+	now := time.Now()
+
+	statement := `DELETE FROM idempotency_keys WHERE user_id=$1 AND idempotency_key=$2 AND created_at<$3`
+	_, err := r.db.Exec(statement, userID, key, now.Add(-idempotencyKeyTTL).Unix())
+	if err != nil {
+		log.Error("expiring idempotency_keys failed.")
+		return IdempotentRequest{}, false, err
+	}
+
+	statement = `INSERT INTO idempotency_keys(user_id, idempotency_key, request_hash, created_at) VALUES($1, $2, $3, $4)
+  ON CONFLICT DO NOTHING`
+	result, err := r.db.Exec(statement, userID, key, requestHash, now.Unix())
+	if err != nil {
+		log.Error("inserting to idempotency_keys failed.")
+		return IdempotentRequest{}, false, err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return IdempotentRequest{}, false, err
+	}
+
+	if number == 1 {
+		return IdempotentRequest{RequestHash: requestHash, CreatedAt: now}, true, nil
+	}
+
+	stored := IdempotentRequest{}
+	var body sql.NullString
+	var createdAt int64
+
+	statement = `SELECT request_hash, status_code, response_body, created_at FROM idempotency_keys WHERE user_id=$1 AND idempotency_key=$2`
+	err = r.db.QueryRow(statement, userID, key).Scan(&stored.RequestHash, &stored.StatusCode, &body, &createdAt)
+	if err != nil {
+		log.Error(err)
+		return stored, false, err
+	}
+
+	stored.Body = []byte(body.String)
+	stored.CreatedAt = time.Unix(createdAt, 0)
+	return stored, false, nil
+}
+
+func (r *SQLRepository) CompleteIdempotent(userID int, key string, code int, body []byte) error {
+	statement := `UPDATE idempotency_keys SET status_code=$1, response_body=$2 WHERE user_id=$3 AND idempotency_key=$4`
+	_, err := r.db.Exec(statement, code, string(body), userID, key)
+	return err
+}
+
+func (r *SQLRepository) AbandonIdempotent(userID int, key string) error {
+	_, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE user_id=$1 AND idempotency_key=$2`, userID, key)
+	return err
+}
+
+func (r *SQLRepository) CreateSession(userID int, tokenHash string, expiresAt time.Time) (int, error) {
+	statement := `INSERT INTO refresh_tokens(user_id, token_hash, expires_at) VALUES($1, $2, $3)`
+	id, err := r.dialect.insert(r.db, statement, userID, tokenHash, expiresAt.Unix())
+	if err != nil {
+		log.Error("inserting to refresh_tokens failed.")
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// RedeemSession revokes the live session holding the token hash and returns
+// its user. The revoke only succeeds once, so concurrent redeems of the same
+// refresh token can not both win.
+func (r *SQLRepository) RedeemSession(tokenHash string) (User, error) {
+	u := User{}
+
+	statement := `SELECT refresh_tokens.id, users.id, users.name, users.role FROM refresh_tokens
+  INNER JOIN users ON refresh_tokens.user_id=users.id
+  WHERE refresh_tokens.token_hash=$1 AND refresh_tokens.revoked=0 AND refresh_tokens.expires_at>$2`
+
+	var sessionID int
+	err := r.db.QueryRow(statement, tokenHash, time.Now().Unix()).Scan(&sessionID, &u.ID, &u.Name, &u.Role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return u, errors.New("Refresh token is invalid.")
+		}
+		return u, err
+	}
+
+	result, err := r.db.Exec(`UPDATE refresh_tokens SET revoked=1 WHERE id=$1 AND revoked=0`, sessionID)
+	if err != nil {
+		log.Error("revoking refresh token failed.")
+		return u, err
+	}
+
+	number, err := result.RowsAffected()
+	if err != nil {
+		return u, err
+	}
+
+	if number == 0 {
+		return u, errors.New("Refresh token is invalid.")
+	}
+
+	return u, nil
+}
+
+func (r *SQLRepository) RevokeSession(id int) error {
+	statement := `UPDATE refresh_tokens SET revoked=1 WHERE id=$1`
+	_, err := r.db.Exec(statement, id)
+	if err != nil {
+		log.Error("revoking refresh token failed.")
+	}
+	return err
+}
+
+func (r *SQLRepository) SessionActive(id int) (bool, error) {
+	statement := `SELECT revoked, expires_at FROM refresh_tokens WHERE id=$1`
+
+	var revoked bool
+	var expiresAt int64
+	err := r.db.QueryRow(statement, id).Scan(&revoked, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return !revoked && time.Now().Unix() < expiresAt, nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The same contract runs against every repository implementation. Set
+// FRANKLIN_TEST_POSTGRES_DSN (e.g. "postgres://localhost/franklin_test?sslmode=disable")
+// to include PostgreSQL; its tables are dropped and migrated from scratch.
+
+func TestSQLiteRepositoryContract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "franklin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "contract.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	testRepositoryContract(t, NewSQLRepository(db, SQLite), sqlItemSeeder(t, db, SQLite))
+}
+
+func TestPostgresRepositoryContract(t *testing.T) {
+	dsn := os.Getenv("FRANKLIN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FRANKLIN_TEST_POSTGRES_DSN is not set.")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// CI sets the DSN, so an unreachable server fails rather than skipping
+	// the Postgres path unnoticed.
+	if err = db.Ping(); err != nil {
+		t.Fatal("PostgreSQL is not reachable: ", err)
+	}
+
+	assert.NoError(t, migrateDown(db, Postgres, len(migrations)))
+	assert.NoError(t, migrateUp(db, Postgres))
+
+	testRepositoryContract(t, NewSQLRepository(db, Postgres), sqlItemSeeder(t, db, Postgres))
+}
+
+func TestMemoryRepositoryContract(t *testing.T) {
+	m := NewMemoryRepository()
+	testRepositoryContract(t, m, func(items ...Item) {
+		for _, i := range items {
+			m.AddItem(i)
+		}
+	})
+}
+
+type contractRepository interface {
+	UserRepository
+	OrderRepository
+	ItemRepository
+	InventoryRepository
+	SessionRepository
+	IdempotencyRepository
+}
+
+func sqlItemSeeder(t *testing.T, db *sql.DB, d Dialect) func(items ...Item) {
+	return func(items ...Item) {
+		for _, i := range items {
+			_, err := db.Exec("INSERT INTO items(id, name, unit_price) VALUES($1, $2, $3)", i.ID, i.Name, i.UnitPrice)
+			assert.NoError(t, err)
+		}
+
+		// Explicit ids do not advance a SERIAL sequence.
+		if d == Postgres {
+			_, err := db.Exec("SELECT setval('items_id_seq', (SELECT MAX(id) FROM items))")
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func testRepositoryContract(t *testing.T, r contractRepository, seedItems func(items ...Item)) {
+	seedItems(Item{ID: 1, Name: "apple", UnitPrice: 50}, Item{ID: 2, Name: "oranges", UnitPrice: 80}, Item{ID: 3, Name: "avacado", UnitPrice: 150})
+
+	store := Store{No: 1253, Name: "Austin Supercenter", City: "Austin", Zip: "78704", SundayOpen: true, Coordinates: []float64{-97.753926, 30.221033}, Distance: 1.67}
+
+	u := User{Name: "Contract User", Email: "contract@example.com", Password: "hash", Role: roleUser, Zipcode: 78704, ClosestStore: store}
+	assert.NoError(t, r.CreateUser(&u))
+	assert.Equal(t, 1, u.ID)
+	assert.Empty(t, u.Password)
+
+	other := User{Name: "Other User", Password: "hash", Role: roleUser, Zipcode: 78704, ClosestStore: store}
+	assert.NoError(t, r.CreateUser(&other))
+	assert.Equal(t, 2, other.ID)
+
+	fetched := User{ID: 1}
+	assert.NoError(t, r.GetUser(&fetched))
+	assert.Equal(t, "Contract User", fetched.Name)
+	assert.Equal(t, "contract@example.com", fetched.Email)
+	assert.Equal(t, store, fetched.ClosestStore)
+
+	assert.Equal(t, sql.ErrNoRows, r.GetUser(&User{ID: 99}))
+
+	users, err := r.GetUsers(10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, Users{{ID: 2, Name: "Other User", Role: roleUser, Zipcode: 78704}}, users)
+
+	credentials, hash, err := r.Credentials("Contract User")
+	assert.NoError(t, err)
+	assert.Equal(t, User{ID: 1, Name: "Contract User", Role: roleUser}, credentials)
+	assert.Equal(t, "hash", hash)
+
+	assert.Equal(t, errDuplicateEmail, r.CreateUser(&User{Name: "Copy User", Email: "contract@example.com", ClosestStore: store}))
+
+	pending, err := r.UnverifiedUser("contract@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, User{ID: 1, Name: "Contract User", Email: "contract@example.com"}, pending)
+
+	assert.Equal(t, sql.ErrNoRows, r.VerifyEmail(1, "other@example.com"))
+	assert.Equal(t, sql.ErrNoRows, r.VerifyEmail(2, ""))
+	assert.NoError(t, r.VerifyEmail(1, "contract@example.com"))
+	assert.NoError(t, r.VerifyEmail(1, "contract@example.com"))
+
+	credentials, _, err = r.Credentials("Contract User")
+	assert.NoError(t, err)
+	assert.True(t, credentials.Verified)
+
+	_, err = r.UnverifiedUser("contract@example.com")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, _, err = r.Credentials("Nobody")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	for id := 1; id <= 3; id++ {
+		assert.NoError(t, r.SetStock(1253, id, 10))
+	}
+	assert.Equal(t, sql.ErrNoRows, r.SetStock(99, 1, 10))
+
+	o := Order{UserID: 1, TaxRate: 825, Items: Items{{ID: 2, Quantity: 3}, {ID: 1}}}
+	assert.NoError(t, r.CreateOrder(&o))
+	assert.Equal(t, 1, o.ID)
+	assert.Equal(t, 314, o.Total)
+
+	got := Order{ID: 1}
+	assert.NoError(t, r.GetOrder(&got, 1))
+	assert.Equal(t, Order{ID: 1, User: "Contract User", UserID: 1, Items: Items{
+		{ID: 1, Name: "apple", Quantity: 1, UnitPrice: 50, LineTotal: 50},
+		{ID: 2, Name: "oranges", Quantity: 3, UnitPrice: 80, LineTotal: 240},
+	}, Subtotal: 290, TaxRate: 825, Tax: 24, Total: 314, Status: statusDraft, StoreNo: 1253, Version: 1}, got)
+
+	assert.Error(t, r.GetOrder(&Order{ID: 1}, 2))
+
+	// Lines already on the order keep the price they were captured at.
+	assert.NoError(t, r.UpdateItem(&Item{ID: 1, Name: "apple", UnitPrice: 60}))
+
+	o.Items = Items{{ID: 1, Quantity: 2}, {ID: 3}}
+	assert.NoError(t, r.UpdateOrder(&o))
+	assert.Equal(t, 271, o.Total)
+	assert.Equal(t, 2, o.Version)
+
+	// Writes against a version that has moved on change nothing.
+	assert.Equal(t, errStaleOrder, r.UpdateOrder(&Order{ID: 1, UserID: 1, Version: 1, Items: Items{{ID: 1}}}))
+	assert.Equal(t, errStaleOrder, r.DeleteOrder(&Order{ID: 1, UserID: 1, Version: 1}))
+
+	assert.Error(t, r.UpdateOrder(&Order{ID: 1, UserID: 2, Items: Items{{ID: 1}}}))
+
+	// An item on two lines is a validation error and changes nothing.
+	err = r.CreateOrder(&Order{UserID: 1, Items: Items{{ID: 2}, {ID: 2}}})
+	assert.Equal(t, &appError{Code: codeValidation, Detail: "Order is invalid.", Fields: []fieldError{{"items[1].id", "is already on another line"}}}, err)
+	err = r.UpdateOrder(&Order{ID: 1, UserID: 1, Items: Items{{ID: 1}, {ID: 3}, {ID: 1, Quantity: 5}}})
+	assert.Equal(t, &appError{Code: codeValidation, Detail: "Order is invalid.", Fields: []fieldError{{"items[2].id", "is already on another line"}}}, err)
+
+	orders, next, err := r.GetOrders(1, OrderQuery{Limit: 10, Sort: sortNewest})
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+	assert.Equal(t, Orders{{ID: 1, User: "Contract User", UserID: 1, Items: Items{
+		{ID: 1, Name: "apple", Quantity: 2, UnitPrice: 50, LineTotal: 100},
+		{ID: 3, Name: "avacado", Quantity: 1, UnitPrice: 150, LineTotal: 150},
+	}, Subtotal: 250, TaxRate: 825, Tax: 21, Total: 271, Status: statusDraft, StoreNo: 1253, Version: 2}}, orders)
+
+	inventory, err := r.GetInventory(1253)
+	assert.NoError(t, err)
+	assert.Equal(t, []Stock{
+		{StoreNo: 1253, ItemID: 1, OnHand: 10, Reserved: 2, Available: 8},
+		{StoreNo: 1253, ItemID: 2, OnHand: 10, Reserved: 0, Available: 10},
+		{StoreNo: 1253, ItemID: 3, OnHand: 10, Reserved: 1, Available: 9},
+	}, inventory)
+
+	short, isShort := r.CreateOrder(&Order{UserID: 2, Items: Items{{ID: 3, Quantity: 20}, {ID: 2}}}).(*insufficientStockError)
+	assert.True(t, isShort)
+	assert.Equal(t, []Shortage{{ItemID: 3, Requested: 20, Available: 9}}, short.Items)
+
+	assert.Equal(t, errStockReserved, r.SetStock(1253, 1, 1))
+
+	placed := Order{UserID: 1, Items: Items{{ID: 2}}}
+	assert.NoError(t, r.CreateOrder(&placed))
+	assert.Equal(t, 2, placed.ID)
+
+	assert.Error(t, r.TransitionOrder(&Order{ID: 2, UserID: 2}, statusPlaced))
+
+	_, isInvalid := r.TransitionOrder(&Order{ID: 2, UserID: 1}, statusPicking).(*invalidTransitionError)
+	assert.True(t, isInvalid)
+
+	assert.NoError(t, r.TransitionOrder(&Order{ID: 2, UserID: 1}, statusPlaced))
+
+	staff := Order{ID: 2}
+	assert.NoError(t, r.TransitionOrder(&staff, statusPicking))
+	assert.Equal(t, 1, staff.UserID)
+	assert.Equal(t, statusPicking, staff.Status)
+
+	assert.Equal(t, errOrderLocked, r.UpdateOrder(&Order{ID: 2, UserID: 1, Items: Items{{ID: 1}}}))
+	assert.Equal(t, errOrderLocked, r.DeleteOrder(&Order{ID: 2, UserID: 1}))
+
+	picking := Order{ID: 2}
+	assert.NoError(t, r.GetOrder(&picking, 1))
+	assert.Equal(t, statusPicking, picking.Status)
+	assert.Equal(t, 3, picking.Version)
+	assert.Equal(t, 2, len(picking.Transitions))
+	assert.Equal(t, statusDraft, picking.Transitions[0].From)
+	assert.Equal(t, statusPlaced, picking.Transitions[0].To)
+	assert.WithinDuration(t, time.Now(), picking.Transitions[1].At, time.Minute)
+
+	// Completing takes the reserved stock away, cancelling gives it back.
+	assert.NoError(t, r.TransitionOrder(&Order{ID: 2}, statusReady))
+	assert.NoError(t, r.TransitionOrder(&Order{ID: 2}, statusCompleted))
+
+	inventory, err = r.GetInventory(1253)
+	assert.NoError(t, err)
+	assert.Equal(t, Stock{StoreNo: 1253, ItemID: 2, OnHand: 9, Reserved: 0, Available: 9}, inventory[1])
+
+	cancelled := Order{UserID: 2, Items: Items{{ID: 2, Quantity: 4}}}
+	assert.NoError(t, r.CreateOrder(&cancelled))
+	assert.NoError(t, r.TransitionOrder(&Order{ID: cancelled.ID, UserID: 2}, statusCancelled))
+
+	assert.Error(t, r.DeleteOrder(&Order{ID: 1, UserID: 2}))
+
+	// Listings page on a cursor and can be filtered and sorted.
+	orders, next, err = r.GetOrders(1, OrderQuery{Limit: 1, Sort: sortNewest})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, orders[0].ID)
+	assert.Equal(t, 2, next.ID)
+
+	orders, next, err = r.GetOrders(1, OrderQuery{Limit: 1, Sort: sortNewest, After: next})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, orders[0].ID)
+	assert.Nil(t, next)
+
+	orders, _, err = r.GetOrders(1, OrderQuery{Limit: 10, Sort: sortTotal})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 1}, []int{orders[0].ID, orders[1].ID})
+
+	orders, next, err = r.GetOrders(1, OrderQuery{Limit: 1, Sort: sortTotalDesc})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, orders[0].ID)
+	assert.Equal(t, OrderCursor{Key: 271, ID: 1}, *next)
+
+	orders, _, err = r.GetOrders(1, OrderQuery{Limit: 10, Sort: sortNewest, Statuses: []string{statusCompleted, statusCancelled}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, 2, orders[0].ID)
+
+	orders, _, err = r.GetOrders(1, OrderQuery{Limit: 10, Sort: sortNewest, ItemID: 3, To: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, 1, orders[0].ID)
+
+	orders, next, err = r.GetOrders(1, OrderQuery{Limit: 10, Sort: sortNewest, From: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, Orders{}, orders)
+	assert.Nil(t, next)
+
+	kiwi := Item{Name: "kiwi", SKU: "FRT-004", UnitPrice: 45, Category: "fruit"}
+	assert.NoError(t, r.CreateItem(&kiwi))
+	assert.Equal(t, 4, kiwi.ID)
+
+	assert.Equal(t, errDuplicateSKU, r.CreateItem(&Item{Name: "green kiwi", SKU: "FRT-004"}))
+
+	kiwi.UnitPrice = 55
+	assert.NoError(t, r.UpdateItem(&kiwi))
+
+	assert.Equal(t, sql.ErrNoRows, r.UpdateItem(&Item{ID: 99, Name: "ghost"}))
+
+	assert.NoError(t, r.ArchiveItem(4))
+	assert.Equal(t, sql.ErrNoRows, r.ArchiveItem(99))
+
+	fetchedItem := Item{ID: 4}
+	assert.NoError(t, r.GetItem(&fetchedItem))
+	assert.Equal(t, Item{ID: 4, Name: "kiwi", SKU: "FRT-004", UnitPrice: 55, Category: "fruit", Archived: true}, fetchedItem)
+
+	items, err := r.GetItems(10, 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, Items{{ID: 3, Name: "avacado", UnitPrice: 150}}, items)
+
+	items, err = r.GetItems(10, 3, true)
+	assert.NoError(t, err)
+	assert.Equal(t, Items{fetchedItem}, items)
+
+	_, isInvalid = r.UpdateOrder(&Order{ID: 1, UserID: 1, Items: Items{{ID: 1}, {ID: 4}}}).(*invalidItemsError)
+	assert.True(t, isInvalid)
+
+	_, isInvalid = r.CreateOrder(&Order{UserID: 1, Items: Items{{ID: 5}}}).(*invalidItemsError)
+	assert.True(t, isInvalid)
+	assert.NoError(t, r.DeleteOrder(&Order{ID: 1, UserID: 1}))
+	assert.Error(t, r.GetOrder(&Order{ID: 1}, 1))
+
+	history, err := r.OrderHistory(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, Revision{Version: 2, Action: revisionUpdated, UserID: 1, User: "Contract User", At: history[1].At, Changes: []LineChange{
+		{ItemID: 1, From: 1, To: 2}, {ItemID: 2, From: 3, To: 0}, {ItemID: 3, From: 0, To: 1},
+	}}, history[1])
+	assert.Equal(t, revisionDeleted, history[2].Action)
+	assert.Equal(t, []LineChange{{ItemID: 1, From: 2, To: 0}, {ItemID: 3, From: 1, To: 0}}, history[2].Changes)
+
+	_, err = r.OrderHistory(1, 2)
+	assert.Error(t, err)
+
+	history, err = r.OrderHistory(1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(history))
+
+	inventory, err = r.GetInventory(1253)
+	assert.NoError(t, err)
+	for _, stock := range inventory {
+		assert.Equal(t, 0, stock.Reserved)
+	}
+
+	// Deleted orders come back with their stock reserved again, until they
+	// are purged.
+	restored := Order{ID: 1, UserID: 1}
+	assert.NoError(t, r.RestoreOrder(&restored, time.Now().Add(-time.Hour)))
+	assert.NoError(t, r.GetOrder(&Order{ID: 1}, 1))
+	assert.Equal(t, 4, restored.Version)
+
+	inventory, err = r.GetInventory(1253)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inventory[0].Reserved)
+
+	assert.Error(t, r.RestoreOrder(&Order{ID: 1, UserID: 1}, time.Now().Add(-time.Hour)))
+	assert.NoError(t, r.DeleteOrder(&Order{ID: 1, UserID: 1}))
+	assert.Error(t, r.RestoreOrder(&Order{ID: 1, UserID: 2}, time.Now().Add(-time.Hour)))
+	assert.Equal(t, errRestoreExpired, r.RestoreOrder(&Order{ID: 1, UserID: 1}, time.Now().Add(time.Hour)))
+
+	purged, err := r.PurgeOrders(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Error(t, r.RestoreOrder(&Order{ID: 1, UserID: 1}, time.Now().Add(-time.Hour)))
+
+	history, err = r.OrderHistory(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(history))
+	assert.Equal(t, revisionRestored, history[3].Action)
+
+	assert.Equal(t, errOrderNotFound, r.GetOrder(&Order{ID: 1}, 1))
+	assert.Equal(t, errOrderNotFound, r.UpdateOrder(&Order{ID: 1, UserID: 1, Items: Items{{ID: 1}}}))
+	assert.Equal(t, errOrderNotFound, r.DeleteOrder(&Order{ID: 1, UserID: 1}))
+	assert.Equal(t, errOrderNotFound, r.TransitionOrder(&Order{ID: 1, UserID: 1}, statusCancelled))
+
+	// Drafts can be empty, but can not be placed until they have items.
+	empty := Order{UserID: 2}
+	assert.NoError(t, r.CreateOrder(&empty))
+
+	draft := Order{ID: empty.ID}
+	assert.NoError(t, r.GetOrder(&draft, 2))
+	assert.Equal(t, Items{}, draft.Items)
+	assert.Equal(t, statusDraft, draft.Status)
+
+	assert.Equal(t, errEmptyOrder, r.TransitionOrder(&Order{ID: empty.ID, UserID: 2}, statusPlaced))
+	assert.NoError(t, r.UpdateOrder(&Order{ID: empty.ID, UserID: 2, Items: Items{{ID: 2}}}))
+	assert.NoError(t, r.TransitionOrder(&Order{ID: empty.ID, UserID: 2}, statusPlaced))
+	assert.Equal(t, errEmptyOrder, r.UpdateOrder(&Order{ID: empty.ID, UserID: 2}))
+
+	sessionID, err := r.CreateSession(1, "token-hash", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	active, err := r.SessionActive(sessionID)
+	assert.NoError(t, err)
+	assert.True(t, active)
+
+	redeemed, err := r.RedeemSession("token-hash")
+	assert.NoError(t, err)
+	assert.Equal(t, User{ID: 1, Name: "Contract User", Role: roleUser}, redeemed)
+
+	_, err = r.RedeemSession("token-hash")
+	assert.Error(t, err)
+
+	active, err = r.SessionActive(sessionID)
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	expiredID, err := r.CreateSession(1, "expired-hash", time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+
+	active, err = r.SessionActive(expiredID)
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	_, err = r.RedeemSession("expired-hash")
+	assert.Error(t, err)
+
+	revokedID, err := r.CreateSession(2, "revoked-hash", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, r.RevokeSession(revokedID))
+
+	active, err = r.SessionActive(revokedID)
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	_, claimed, err := r.BeginIdempotent(1, "key-1", "hash-1")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	stored, claimed, err := r.BeginIdempotent(1, "key-1", "hash-1")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, "hash-1", stored.RequestHash)
+	assert.Equal(t, 0, stored.StatusCode)
+
+	_, claimed, err = r.BeginIdempotent(2, "key-1", "hash-2")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	assert.NoError(t, r.CompleteIdempotent(1, "key-1", 200, []byte(`{"id":1}`)))
+
+	stored, claimed, err = r.BeginIdempotent(1, "key-1", "hash-1")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, 200, stored.StatusCode)
+	assert.Equal(t, `{"id":1}`, string(stored.Body))
+
+	assert.NoError(t, r.AbandonIdempotent(2, "key-1"))
+
+	_, claimed, err = r.BeginIdempotent(2, "key-1", "hash-3")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// Concurrent signups with one address create one account, the others
+	// are told the address is taken.
+	signups := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			signups <- r.CreateUser(&User{Name: "Racing User", Email: "race@example.com", Password: "hash", Role: roleUser, ClosestStore: store})
+		}()
+	}
+
+	created := 0
+	for i := 0; i < 5; i++ {
+		if err := <-signups; err == nil {
+			created++
+		} else {
+			assert.Equal(t, errDuplicateEmail, err)
+		}
+	}
+	assert.Equal(t, 1, created)
+}
+
+// SQLite serializes the signups above before they reach the unique index, so
+// the driver error CreateUser maps when they do not is checked directly.
+func TestSQLiteUniqueViolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "franklin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "unique.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, migrateUp(db, SQLite))
+
+	_, err = db.Exec("INSERT INTO users(name, email) VALUES('First', 'taken@example.com')")
+	assert.NoError(t, err)
+	assert.False(t, isUniqueViolation(err))
+
+	_, err = db.Exec("INSERT INTO users(name, email) VALUES('Second', 'taken@example.com')")
+	assert.True(t, isUniqueViolation(err))
+
+	_, err = db.Exec("INSERT INTO users(email) VALUES('nameless@example.com')")
+	assert.Error(t, err)
+	assert.False(t, isUniqueViolation(err))
+}
+
+// BenchmarkSQLiteGetOrders pages through the orders of a user with thousands
+// of them, against the query per order on the page it used to take.
+func BenchmarkSQLiteGetOrders(b *testing.B) {
+	const orders, lines = 5000, 3
+
+	dir, err := ioutil.TempDir("", "franklin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = migrateUp(db, SQLite); err != nil {
+		b.Fatal(err)
+	}
+
+	if err = seedBenchmarkOrders(db, orders, lines); err != nil {
+		b.Fatal(err)
+	}
+
+	r := NewSQLRepository(db, SQLite)
+	loaders := []struct {
+		name string
+		load func(q OrderQuery) (Orders, *OrderCursor, error)
+	}{
+		{"per-order", func(q OrderQuery) (Orders, *OrderCursor, error) { return getOrdersPerOrder(r, 1, q) }},
+		{"two-queries", func(q OrderQuery) (Orders, *OrderCursor, error) { return r.GetOrders(1, q) }},
+	}
+
+	for _, loader := range loaders {
+		for _, count := range []int{10, 100} {
+			load := loader.load
+			b.Run(fmt.Sprintf("%s/count=%d", loader.name, count), func(b *testing.B) {
+				q := OrderQuery{Limit: count, Sort: sortNewest}
+				for n := 0; n < b.N; n++ {
+					page, next, err := load(q)
+					if err != nil || len(page) != count {
+						b.Fatal("unexpected page: ", len(page), err)
+					}
+					// Start over after the last page.
+					q.After = next
+				}
+			})
+		}
+	}
+}
+
+// getOrdersPerOrder is the baseline of the benchmark: a page of the newest
+// orders read the way GetOrders used to, a query for the page and then one
+// per order.
+func getOrdersPerOrder(r *SQLRepository, userID int, q OrderQuery) (Orders, *OrderCursor, error) {
+	after := OrderCursor{Key: 1<<63 - 1, ID: 1<<31 - 1}
+	if q.After != nil {
+		after = *q.After
+	}
+
+	statement := `SELECT id, created_at FROM orders
+  WHERE user_id=$1 AND deleted_at IS NULL AND (created_at<$2 OR (created_at=$2 AND id<$3))
+  ORDER BY created_at DESC, id DESC LIMIT $4`
+
+	rows, err := r.db.Query(statement, userID, after.Key, after.ID, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cursors []OrderCursor
+	for rows.Next() {
+		c := OrderCursor{}
+		if err = rows.Scan(&c.ID, &c.Key); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		cursors = append(cursors, c)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *OrderCursor
+	if len(cursors) > q.Limit {
+		cursors = cursors[:q.Limit]
+		next = &cursors[q.Limit-1]
+	}
+
+	orders := Orders{}
+	for _, c := range cursors {
+		o := Order{ID: c.ID}
+		if err = r.GetOrder(&o, userID); err != nil {
+			return nil, nil, err
+		}
+		orders = append(orders, o)
+	}
+
+	return orders, next, nil
+}
+
+// seedBenchmarkOrders gives the benchmark's user the orders, each with the
+// same lines, in one transaction.
+func seedBenchmarkOrders(db *sql.DB, orders, lines int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("INSERT INTO users(id, name, password) VALUES(1, 'Bench User', 'hash')"); err != nil {
+		return err
+	}
+
+	for id := 1; id <= lines; id++ {
+		if _, err = tx.Exec("INSERT INTO items(id, name, unit_price) VALUES($1, $2, 100)", id, fmt.Sprintf("item %d", id)); err != nil {
+			return err
+		}
+	}
+
+	for id := 1; id <= orders; id++ {
+		if _, err = tx.Exec("INSERT INTO orders(id, user_id) VALUES($1, 1)", id); err != nil {
+			return err
+		}
+
+		for item := 1; item <= lines; item++ {
+			if _, err = tx.Exec("INSERT INTO order_items(order_id, item_id, quantity, unit_price) VALUES($1, $2, 1, 100)", id, item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Tokens is the payload handed back to clients on signin and refresh.
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// claims are the signed contents of an access token. SessionID points at the
+// refresh_tokens row the access token was minted from, so revoking that row
+// on signout also invalidates every access token issued for it.
+type claims struct {
+	UserID    int    `json:"uid"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	SessionID int    `json:"sid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// newTokenSecret generates a random signing key. Tokens signed with it do not
+// survive a restart, which is only acceptable when no secret is configured.
+func newTokenSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("could not generate token secret: ", err)
+	}
+	return secret
+}
+
+func signAccessToken(secret []byte, c claims) (string, error) {
+	return signToken(secret, "", c)
+}
+
+func parseAccessToken(secret []byte, token string) (claims, error) {
+	c := claims{}
+	if err := parseToken(secret, "", token, &c); err != nil {
+		return c, err
+	}
+
+	if time.Now().Unix() >= c.ExpiresAt {
+		return c, errors.New("Token expired.")
+	}
+
+	return c, nil
+}
+
+// signToken encodes v as the payload of a token. The purpose is signed along
+// with it, so a token minted for one purpose is not accepted for another.
+// Access tokens have none, which keeps the tokens already handed out valid.
+func signToken(secret []byte, purpose string, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sign(secret, purpose+encoded), nil
+}
+
+// parseToken checks the signature of a token and decodes its payload into v.
+// Expiry is left to the caller.
+func parseToken(secret []byte, purpose, token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return errors.New("Malformed token.")
+	}
+
+	if !hmac.Equal([]byte(sign(secret, purpose+parts[0])), []byte(parts[1])) {
+		return errors.New("Invalid token signature.")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
+func sign(secret []byte, data string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueTokens persists a new refresh token for the user and mints an access
+// token bound to it.
+func issueTokens(sessions SessionRepository, secret []byte, u User) (Tokens, error) {
+	refresh, err := randomToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	sessionID, err := sessions.CreateSession(u.ID, hashToken(refresh), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	access, err := signAccessToken(secret, claims{
+		UserID:    u.ID,
+		Name:      u.Name,
+		Role:      u.Role,
+		SessionID: sessionID,
+		ExpiresAt: time.Now().Add(accessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,13 +2,10 @@ package main
 
 import "math/rand"
 
-// FIXME: need more robust validations (github.com/asaskevich/govalidator)
-func userValidations(username string, password string) bool {
-	if len(username) >= 255 {
-		return false
-	}
-	return true
-
+// credentialValidations only bounds what is looked up on sign in; the rules
+// for new accounts are in User.violations.
+func credentialValidations(username string, password string) bool {
+	return len(username) <= maxNameLength && len(password) <= maxPasswordLength
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -20,22 +17,3 @@ func randSeq(n int) string {
 	}
 	return string(b)
 }
-
-func compare(X, Y []int) []int {
-	m := make(map[int]int)
-
-	for _, y := range Y {
-		m[y]++
-	}
-
-	var ret []int
-	for _, x := range X {
-		if m[x] > 0 {
-			m[x]--
-			continue
-		}
-		ret = append(ret, x)
-	}
-
-	return ret
-}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxNameLength     = 254
+	maxEmailLength    = 254
+	minPasswordLength = 8
+	// bcrypt ignores anything past 72 bytes.
+	maxPasswordLength = 72
+	maxSKULength      = 64
+	maxCategoryLength = 64
+	maxDescription    = 1000
+	maxOrderLines     = 100
+	maxLineQuantity   = 1000
+)
+
+// payload is a request body that knows the rules its fields must follow.
+type payload interface {
+	violations() []fieldError
+}
+
+// check is a field and what its rules found wrong with it, in the order the
+// rules are listed. Only the first is reported, as later rules tend to follow
+// from it.
+type check struct {
+	field    string
+	problems []string
+}
+
+func field(name string, problems ...string) check {
+	return check{name, problems}
+}
+
+// validate runs every check and returns all the fields that failed.
+func validate(checks ...check) []fieldError {
+	var fields []fieldError
+	for _, c := range checks {
+		for _, problem := range c.problems {
+			if problem != "" {
+				fields = append(fields, fieldError{c.field, problem})
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// Rules return what is wrong with a value, or "" when it is fine.
+
+func required(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "is required"
+	}
+	return ""
+}
+
+func minLength(s string, min int) string {
+	if len(s) < min {
+		return fmt.Sprintf("must be at least %d characters", min)
+	}
+	return ""
+}
+
+func maxLength(s string, max int) string {
+	if len(s) > max {
+		return fmt.Sprintf("must be at most %d characters", max)
+	}
+	return ""
+}
+
+func atLeast(n, min int) string {
+	if n < min {
+		return fmt.Sprintf("must be at least %d", min)
+	}
+	return ""
+}
+
+func atMost(n, max int) string {
+	if n > max {
+		return fmt.Sprintf("must be at most %d", max)
+	}
+	return ""
+}
+
+// strongPassword asks for letters mixed with digits or symbols.
+func strongPassword(s string) string {
+	var letters, others bool
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else if !unicode.IsSpace(r) {
+			others = true
+		}
+	}
+	if !letters || !others {
+		return "must mix letters with digits or symbols"
+	}
+	return ""
+}
+
+// emailAddress accepts a bare address like someone@example.com, without a
+// display name.
+func emailAddress(s string) string {
+	if address, err := mail.ParseAddress(s); err != nil || address.Address != s {
+		return "must be an email address"
+	}
+	return ""
+}
+
+// unique rejects an id seen before, and remembers it for the next ones.
+func unique(id int, seen map[int]bool) string {
+	if seen[id] {
+		return "is already on another line"
+	}
+	seen[id] = true
+	return ""
+}
+
+// usZipcode accepts the range of 5 digit ZIP codes in use, 00501 to 99950.
+func usZipcode(zipcode int) string {
+	if zipcode < 501 || zipcode > 99950 {
+		return "must be a 5 digit US ZIP code"
+	}
+	return ""
+}
+
+func (u User) violations() []fieldError {
+	return validate(
+		field("name", required(u.Name), maxLength(u.Name, maxNameLength)),
+		field("email", required(u.Email), maxLength(u.Email, maxEmailLength), emailAddress(u.Email)),
+		field("password", required(u.Password), minLength(u.Password, minPasswordLength),
+			maxLength(u.Password, maxPasswordLength), strongPassword(u.Password)),
+		field("zipcode", usZipcode(u.Zipcode)),
+	)
+}
+
+// violations of an order only cover its lines, as everything else about it
+// is set by the server. A zero quantity means 1.
+func (o Order) violations() []fieldError {
+	checks := []check{field("items", atMost(len(o.Items), maxOrderLines))}
+	seen := make(map[int]bool)
+	for i, line := range o.Items {
+		path := fmt.Sprintf("items[%d]", i)
+		checks = append(checks,
+			field(path+".id", atLeast(line.ID, 1), unique(line.ID, seen)),
+			field(path+".quantity", atLeast(line.Quantity, 0), atMost(line.Quantity, maxLineQuantity)),
+		)
+	}
+	return validate(checks...)
+}
+
+func (i Item) violations() []fieldError {
+	return validate(
+		field("name", required(i.Name), maxLength(i.Name, maxNameLength)),
+		field("sku", maxLength(i.SKU, maxSKULength)),
+		field("description", maxLength(i.Description, maxDescription)),
+		field("category", maxLength(i.Category, maxCategoryLength)),
+		field("unit_price", atLeast(i.UnitPrice, 0)),
+	)
+}
+
+// validationError wraps the violations of a payload, nil if there are none.
+func validationError(detail string, fields []fieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &appError{Code: codeValidation, Detail: detail, Fields: fields}
+}
+
+// decodePayload decodes a request body into p and validates it. Fields p does
+// not have, values of the wrong type and rule violations are all reported
+// together; a body that is not JSON at all is an invalid request.
+func decodePayload(body io.Reader, p payload, detail string) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return &appError{Code: codeInvalidRequest, Detail: detail}
+	}
+
+	var doc interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return &appError{Code: codeInvalidRequest, Detail: detail}
+	}
+
+	var fields []fieldError
+	for _, name := range unknownFields(doc, reflect.TypeOf(p), "") {
+		fields = append(fields, fieldError{name, "is not a known field"})
+	}
+
+	// Unmarshal carries on past values of the wrong type, so the rest of the
+	// payload is still validated.
+	if err = json.Unmarshal(data, p); err != nil {
+		typeErr, ok := err.(*json.UnmarshalTypeError)
+		if !ok || typeErr.Field == "" {
+			return &appError{Code: codeInvalidRequest, Detail: detail}
+		}
+		fields = append(fields, fieldError{typeErr.Field, "must be " + jsonType(typeErr.Type)})
+	}
+
+	return validationError(detail, append(fields, p.violations()...))
+}
+
+// jsonType names the kind of JSON value a Go type is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return "a number"
+}
+
+// unknownFields lists the keys of a decoded JSON document that t has no field
+// for, also in nested objects and arrays, as paths like items[0].qty.
+func unknownFields(doc interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			name := key
+			if path != "" {
+				name = path + "." + key
+			}
+
+			// encoding/json matches keys to fields regardless of case.
+			f, ok := fields[strings.ToLower(key)]
+			if !ok {
+				unknown = append(unknown, name)
+				continue
+			}
+			unknown = append(unknown, unknownFields(value[key], f, name)...)
+		}
+
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+		for i, elem := range value {
+			unknown = append(unknown, unknownFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return unknown
+}
+
+// jsonFields maps the lowercased JSON names of a struct's fields to their
+// types, the fields of untagged embedded structs included.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for embedded, typ := range jsonFields(f.Type) {
+				fields[embedded] = typ
+			}
+			continue
+		}
+
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
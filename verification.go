@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	verificationTTL = 48 * time.Hour
+	// verificationPurpose is signed into verification links, so they can not
+	// be used as access tokens and the other way around.
+	verificationPurpose = "verify."
+	defaultBaseURL      = "http://localhost:8080"
+)
+
+// verification is the signed content of the link mailed on signup. The
+// address is part of it, so a link only verifies the address it was sent to.
+type verification struct {
+	UserID    int    `json:"uid"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// verificationLink is the URL that verifies the user's current address.
+func (a *App) verificationLink(u User) (string, error) {
+	token, err := signToken(a.TokenSecret, verificationPurpose, verification{
+		UserID:    u.ID,
+		Email:     u.Email,
+		ExpiresAt: time.Now().Add(verificationTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(a.BaseURL, "/") + "/users/verify?token=" + url.QueryEscape(token), nil
+}
+
+func (a *App) sendVerification(u User) error {
+	link, err := a.verificationLink(u)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\r\n\r\n"+
+		"Open the link below to verify your email address and start ordering:\r\n\r\n"+
+		"%s\r\n\r\n"+
+		"The link expires in %d hours. If you did not sign up, you can ignore this email.\r\n",
+		u.Name, link, int(verificationTTL.Hours()))
+
+	return a.Mailer.Send(Mail{To: u.Email, Subject: "Verify your email address", Body: body})
+}
+
+// verifyEmail follows the link mailed on signup. Browsers are sent on to
+// VerifiedRedirect when one is configured.
+func (a *App) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	v := verification{}
+	if err := parseToken(a.TokenSecret, verificationPurpose, r.URL.Query().Get("token"), &v); err != nil {
+		log.Error(err)
+		respondWithProblem(w, &appError{Code: codeInvalidVerification, Detail: "Verification link is invalid."}, "")
+		return
+	}
+
+	if time.Now().Unix() >= v.ExpiresAt {
+		log.Error("expired verification link used by user: ", v.UserID)
+		respondWithProblem(w, &appError{Code: codeVerificationExpired, Detail: "Verification link expired, request a new one."}, "")
+		return
+	}
+
+	if err := a.Users.VerifyEmail(v.UserID, v.Email); err != nil {
+		log.Error(err)
+		if err == sql.ErrNoRows {
+			respondWithProblem(w, &appError{Code: codeInvalidVerification, Detail: "Verification link is invalid."}, "")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Email address could not be verified.")
+		return
+	}
+
+	if a.VerifiedRedirect != "" {
+		http.Redirect(w, r, a.VerifiedRedirect, http.StatusSeeOther)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Email address verified."})
+}
+
+// resendVerification mails a new link to an account pending verification,
+// for when the first one expired or never arrived. The response is the same
+// whether or not there is such an account.
+func (a *App) resendVerification(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || emailAddress(body.Email) != "" {
+		log.Error("verification requested for an invalid address")
+		respondWithProblem(w, invalidField("email", "Email address is invalid."), "")
+		return
+	}
+
+	u, err := a.Users.UnverifiedUser(body.Email)
+	if err == nil {
+		if err = a.sendVerification(u); err != nil {
+			log.Error("sending verification to user ", u.ID, " failed: ", err)
+		}
+	} else if err != sql.ErrNoRows {
+		log.Error(err)
+		respondWithError(w, http.StatusInternalServerError, "Verification could not be sent.")
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, map[string]string{"message": "A new link is mailed if the address is pending verification."})
+}